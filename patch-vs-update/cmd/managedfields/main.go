@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rancher/wrangler/v3/pkg/kubeconfig"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/structured-merge-diff/v4/fieldpath"
+)
+
+var (
+	group     = flag.String("group", "", "Group of the resource")
+	version   = flag.String("version", "v1", "Version of the resource")
+	resource  = flag.String("resource", "configmaps", "Resource (plural) to inspect")
+	namespace = flag.String("namespace", "default", "Namespace of the object, empty for cluster-scoped objects")
+	name      = flag.String("name", "patch", "Name of the object")
+
+	patch        = flag.String("patch", "", "If set, send this patch and print the ownership diff before/after")
+	patchType    = flag.String("patch-type", "merge", "One of merge, strategic, json, apply")
+	fieldManager = flag.String("field-manager", "managedfields-inspector", "Field manager used when sending -patch")
+)
+
+// This command shows who owns which field of an object, based on its
+// .metadata.managedFields. It's useful to run after the patch-vs-update
+// tutorials to see how Update, Patch and Apply each record ownership.
+//
+// By default, it prints the ownership tree of the object:
+//
+//	go run ./cmd/managedfields -name patch
+//
+// With -patch, it sends the patch and prints which field ownership changed:
+//
+//	go run ./cmd/managedfields -name patch -patch-type apply -patch '{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"patch","namespace":"default"},"data":{"hello":"apply"}}'
+func main() {
+	if err := mainErr(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func mainErr() error {
+	flag.Parse()
+
+	restCfg, err := kubeconfig.GetNonInteractiveClientConfig(os.Getenv("KUBECONFIG")).ClientConfig()
+	if err != nil {
+		return err
+	}
+	dynClient, err := dynamic.NewForConfig(restCfg)
+	if err != nil {
+		return err
+	}
+
+	client := dynClient.Resource(schema.GroupVersionResource{
+		Group:    *group,
+		Version:  *version,
+		Resource: *resource,
+	}).Namespace(*namespace)
+
+	ctx := context.Background()
+	obj, err := client.Get(ctx, *name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	before, err := ownershipTree(obj.GetManagedFields())
+	if err != nil {
+		return err
+	}
+
+	if *patch == "" {
+		before.print(os.Stdout)
+		return nil
+	}
+
+	pt, err := parsePatchType(*patchType)
+	if err != nil {
+		return err
+	}
+	opts := metav1.PatchOptions{
+		FieldManager: *fieldManager,
+	}
+	if pt == types.ApplyPatchType {
+		force := true
+		opts.Force = &force
+	}
+	patched, err := client.Patch(ctx, *name, pt, []byte(*patch), opts)
+	if err != nil {
+		return err
+	}
+	after, err := ownershipTree(patched.GetManagedFields())
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Before:")
+	before.print(os.Stdout)
+	fmt.Println("After:")
+	after.print(os.Stdout)
+	fmt.Println("Ownership changes:")
+	printOwnershipDiff(os.Stdout, before, after)
+	return nil
+}
+
+func parsePatchType(s string) (types.PatchType, error) {
+	switch s {
+	case "merge":
+		return types.MergePatchType, nil
+	case "strategic":
+		return types.StrategicMergePatchType, nil
+	case "json":
+		return types.JSONPatchType, nil
+	case "apply":
+		return types.ApplyPatchType, nil
+	}
+	return "", fmt.Errorf("unknown patch type %q", s)
+}
+
+// owner is one managedFields entry owning a field
+type owner struct {
+	Manager     string
+	Operation   metav1.ManagedFieldsOperationType
+	Subresource string
+	Time        string
+}
+
+// key identifies the owner regardless of when it last touched the field
+func (o owner) key() string {
+	if o.Subresource != "" {
+		return fmt.Sprintf("%s (%s, %s)", o.Manager, o.Operation, o.Subresource)
+	}
+	return fmt.Sprintf("%s (%s)", o.Manager, o.Operation)
+}
+
+func (o owner) String() string {
+	return fmt.Sprintf("%s %s", o.key(), o.Time)
+}
+
+// fieldNode is a node in the ownership tree. Children are keyed by the string
+// representation of their path element (eg: "data", "hello", `[name="nginx"]`).
+type fieldNode struct {
+	children map[string]*fieldNode
+	owners   []owner
+}
+
+func newFieldNode() *fieldNode {
+	return &fieldNode{children: map[string]*fieldNode{}}
+}
+
+func ownershipTree(entries []metav1.ManagedFieldsEntry) (*fieldNode, error) {
+	root := newFieldNode()
+	for _, entry := range entries {
+		if entry.FieldsV1 == nil {
+			continue
+		}
+		set := &fieldpath.Set{}
+		if err := set.FromJSON(bytes.NewReader(entry.FieldsV1.Raw)); err != nil {
+			return nil, fmt.Errorf("parsing managedFields of %s: %w", entry.Manager, err)
+		}
+
+		o := owner{
+			Manager:     entry.Manager,
+			Operation:   entry.Operation,
+			Subresource: entry.Subresource,
+		}
+		if entry.Time != nil {
+			o.Time = entry.Time.UTC().Format("2006-01-02T15:04:05Z")
+		}
+
+		set.Iterate(func(path fieldpath.Path) {
+			node := root
+			for _, element := range path {
+				elementStr := strings.TrimPrefix(element.String(), ".")
+				child, ok := node.children[elementStr]
+				if !ok {
+					child = newFieldNode()
+					node.children[elementStr] = child
+				}
+				node = child
+			}
+			node.owners = append(node.owners, o)
+		})
+	}
+	return root, nil
+}
+
+func (n *fieldNode) print(w io.Writer) {
+	n.printIndent(w, 0)
+}
+
+func (n *fieldNode) printIndent(w io.Writer, depth int) {
+	for _, k := range sortedKeys(n.children) {
+		child := n.children[k]
+		indent := strings.Repeat("  ", depth)
+		if len(child.owners) == 0 {
+			fmt.Fprintf(w, "%s%s\n", indent, k)
+		} else {
+			owners := make([]string, 0, len(child.owners))
+			for _, o := range child.owners {
+				owners = append(owners, o.String())
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", indent, k, strings.Join(owners, ", "))
+		}
+		child.printIndent(w, depth+1)
+	}
+}
+
+// flatten returns, for every owned path, its owners keyed by owner.key()
+func (n *fieldNode) flatten(prefix string, result map[string]map[string]owner) {
+	for k, child := range n.children {
+		path := prefix + "." + k
+		if strings.HasPrefix(k, "[") {
+			path = prefix + k
+		}
+		if len(child.owners) > 0 {
+			result[path] = map[string]owner{}
+			for _, o := range child.owners {
+				result[path][o.key()] = o
+			}
+		}
+		child.flatten(path, result)
+	}
+}
+
+func printOwnershipDiff(w io.Writer, before, after *fieldNode) {
+	beforePaths := map[string]map[string]owner{}
+	before.flatten("", beforePaths)
+	afterPaths := map[string]map[string]owner{}
+	after.flatten("", afterPaths)
+
+	paths := map[string]bool{}
+	for path := range beforePaths {
+		paths[path] = true
+	}
+	for path := range afterPaths {
+		paths[path] = true
+	}
+
+	changed := false
+	for _, path := range sortedKeys(paths) {
+		beforeOwners := beforePaths[path]
+		afterOwners := afterPaths[path]
+
+		keys := map[string]bool{}
+		for k := range beforeOwners {
+			keys[k] = true
+		}
+		for k := range afterOwners {
+			keys[k] = true
+		}
+		for _, k := range sortedKeys(keys) {
+			b, inBefore := beforeOwners[k]
+			a, inAfter := afterOwners[k]
+			switch {
+			case !inBefore:
+				fmt.Fprintf(w, "  + %s: %s\n", path, a)
+			case !inAfter:
+				fmt.Fprintf(w, "  - %s: %s\n", path, b)
+			case a.Time != b.Time:
+				fmt.Fprintf(w, "  ~ %s: %s -> %s\n", path, b, a.Time)
+			default:
+				continue
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		fmt.Fprintln(w, "  (no changes)")
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	wcorev1 "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"github.com/tomleb/lasso-controller-notes/patch-vs-update/pkg/errclass"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const deleteFinalizer = "example.com/block-deletion"
+
+// tutorialDelete shows the following:
+//
+//  1. Delete accepts preconditions on resourceVersion and UID. Like Update and
+//     Patch, sending a stale resourceVersion fails with a conflict. The UID
+//     precondition protects against deleting an object that was deleted and
+//     re-created with the same name in the meantime.
+//
+//  2. An object with finalizers isn't deleted right away. Delete succeeds, but
+//     the object only gets a deletionTimestamp. Controllers see this as a regular
+//     change event, and the object is only gone once the finalizers are removed.
+//
+//  3. The propagation policy decides what happens to dependents (objects with an
+//     ownerReference to the deleted object):
+//     - Background: the owner is deleted right away, the garbage collector
+//     deletes the dependents afterwards.
+//     - Foreground: the owner stays (with a foregroundDeletion finalizer) until
+//     the dependents with blockOwnerDeletion are deleted.
+//     - Orphan: the owner is deleted (after an orphan finalizer is processed) and
+//     the dependents are kept, with their ownerReference removed.
+//
+// It needs the controller (not only the client) because it registers a handler
+// to show what a controller observes.
+func tutorialDelete(ctx context.Context, ctrl wcorev1.ConfigMapController) {
+	fmt.Println("Delete tutorial")
+
+	cm := newTutorialConfigMap("delete")
+	err := ctrl.Delete(cm.Namespace, cm.Name, &metav1.DeleteOptions{})
+	must(ignoreNotFound(err))
+	waitForDeleted(ctx, ctrl, cm.Namespace, cm.Name)
+
+	cm2, err := ctrl.Create(cm)
+	must(err)
+	fmt.Printf("ConfigMap created with rv=%s,uid=%s\n", cm2.ResourceVersion, cm2.UID)
+
+	// Some other client modifies the ConfigMap, so cm2's RV is stale
+	cm3, err := ctrl.Patch(cm2.Namespace, cm2.Name, types.MergePatchType, []byte(`{"data":{"hello":"world"}}`))
+	must(err)
+
+	// Deleting with a stale RV as precondition fails with a conflict
+	err = ctrl.Delete(cm2.Namespace, cm2.Name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			ResourceVersion: &cm2.ResourceVersion,
+		},
+	})
+	mustBe(errclass.Conflict, err)
+	fmt.Printf("ConfigMap not deleted due to conflict, stale rv=%s, current rv=%s\n", cm2.ResourceVersion, cm3.ResourceVersion)
+
+	// Someone else deletes and re-creates the ConfigMap with the same name. It
+	// now has a different UID.
+	must(ctrl.Delete(cm2.Namespace, cm2.Name, &metav1.DeleteOptions{}))
+	waitForDeleted(ctx, ctrl, cm2.Namespace, cm2.Name)
+	cm4, err := ctrl.Create(newTutorialConfigMap("delete"))
+	must(err)
+
+	// Deleting with the old UID as precondition fails with a conflict, we don't
+	// delete an object we never saw
+	err = ctrl.Delete(cm2.Namespace, cm2.Name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			UID: &cm2.UID,
+		},
+	})
+	mustBe(errclass.Conflict, err)
+	fmt.Printf("ConfigMap not deleted due to conflict, old uid=%s, current uid=%s\n", cm2.UID, cm4.UID)
+
+	err = ctrl.Delete(cm4.Namespace, cm4.Name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			UID:             &cm4.UID,
+			ResourceVersion: &cm4.ResourceVersion,
+		},
+	})
+	must(err)
+	fmt.Printf("ConfigMap deleted with uid=%s,rv=%s\n", cm4.UID, cm4.ResourceVersion)
+
+	fmt.Println("")
+	tutorialDeleteFinalizer(ctx, ctrl)
+
+	for _, policy := range []metav1.DeletionPropagation{
+		metav1.DeletePropagationBackground,
+		metav1.DeletePropagationForeground,
+		metav1.DeletePropagationOrphan,
+	} {
+		fmt.Println("")
+		tutorialDeletePropagation(ctx, ctrl, policy)
+	}
+}
+
+func tutorialDeleteFinalizer(ctx context.Context, ctrl wcorev1.ConfigMapController) {
+	cm := newTutorialConfigMap("delete-finalizer")
+	cm.Finalizers = []string{deleteFinalizer}
+
+	deleteLeftover(ctrl, cm.Namespace, cm.Name)
+	waitForDeleted(ctx, ctrl, cm.Namespace, cm.Name)
+
+	// A controller doesn't receive a "delete" event while finalizers are pending,
+	// it receives a change with deletionTimestamp set. This is what wrangler's
+	// OnRemove handlers are built on.
+	ctrl.OnChange(ctx, "tutorial-delete-finalizer", func(key string, obj *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+		if obj == nil || obj.Namespace != cm.Namespace || obj.Name != cm.Name {
+			return obj, nil
+		}
+		if obj.DeletionTimestamp != nil {
+			fmt.Printf("Handler received ConfigMap %s pending deletion since %s, finalizers=%v\n", key, obj.DeletionTimestamp, obj.Finalizers)
+		}
+		return obj, nil
+	})
+
+	cm2, err := ctrl.Create(cm)
+	must(err)
+	fmt.Printf("ConfigMap created with finalizers=%v\n", cm2.Finalizers)
+
+	// Delete succeeds...
+	must(ctrl.Delete(cm2.Namespace, cm2.Name, &metav1.DeleteOptions{}))
+
+	// ...but the object is still there
+	cm3, err := ctrl.Get(cm2.Namespace, cm2.Name, metav1.GetOptions{})
+	must(err)
+	fmt.Printf("ConfigMap still exists after Delete with deletionTimestamp=%s\n", cm3.DeletionTimestamp)
+
+	// The cache eventually receives the same
+	must(wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, 30*time.Second, true, func(ctx context.Context) (bool, error) {
+		cached, err := ctrl.Cache().Get(cm2.Namespace, cm2.Name)
+		if err != nil {
+			return false, err
+		}
+		return cached.DeletionTimestamp != nil, nil
+	}))
+	fmt.Println("ConfigMap in cache has deletionTimestamp set")
+
+	// Removing the last finalizer is what actually deletes the object
+	_, err = ctrl.Patch(cm2.Namespace, cm2.Name, types.MergePatchType, removeFinalizers)
+	must(err)
+	waitForDeleted(ctx, ctrl, cm2.Namespace, cm2.Name)
+	fmt.Println("ConfigMap deleted after removing the finalizer")
+}
+
+func tutorialDeletePropagation(ctx context.Context, ctrl wcorev1.ConfigMapController, policy metav1.DeletionPropagation) {
+	suffix := strings.ToLower(string(policy))
+	owner := newTutorialConfigMap("delete-owner-" + suffix)
+	dependent := newTutorialConfigMap("delete-dependent-" + suffix)
+	for _, cm := range []*corev1.ConfigMap{owner, dependent} {
+		must(ignoreNotFound(ctrl.Delete(cm.Namespace, cm.Name, &metav1.DeleteOptions{})))
+		waitForDeleted(ctx, ctrl, cm.Namespace, cm.Name)
+	}
+
+	owner, err := ctrl.Create(owner)
+	must(err)
+
+	blockOwnerDeletion := true
+	dependent.OwnerReferences = []metav1.OwnerReference{
+		{
+			APIVersion:         "v1",
+			Kind:               "ConfigMap",
+			Name:               owner.Name,
+			UID:                owner.UID,
+			BlockOwnerDeletion: &blockOwnerDeletion,
+		},
+	}
+	_, err = ctrl.Create(dependent)
+	must(err)
+
+	must(ctrl.Delete(owner.Namespace, owner.Name, &metav1.DeleteOptions{
+		PropagationPolicy: &policy,
+	}))
+
+	// Foreground and Orphan are implemented with finalizers on the owner
+	pending, err := ctrl.Get(owner.Namespace, owner.Name, metav1.GetOptions{})
+	if err == nil {
+		fmt.Printf("%s: owner still exists after Delete with finalizers=%v\n", policy, pending.Finalizers)
+	} else {
+		must(ignoreNotFound(err))
+		fmt.Printf("%s: owner deleted right away\n", policy)
+	}
+
+	waitForDeleted(ctx, ctrl, owner.Namespace, owner.Name)
+	fmt.Printf("%s: owner deleted\n", policy)
+
+	if policy == metav1.DeletePropagationOrphan {
+		must(wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, 30*time.Second, true, func(ctx context.Context) (bool, error) {
+			cm, err := ctrl.Get(dependent.Namespace, dependent.Name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return len(cm.OwnerReferences) == 0, nil
+		}))
+		fmt.Printf("%s: dependent kept without ownerReferences\n", policy)
+		must(ctrl.Delete(dependent.Namespace, dependent.Name, &metav1.DeleteOptions{}))
+		return
+	}
+
+	waitForDeleted(ctx, ctrl, dependent.Namespace, dependent.Name)
+	fmt.Printf("%s: dependent deleted by the garbage collector\n", policy)
+}
+
+func newTutorialConfigMap(name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+		Data: map[string]string{
+			"foo": "bar",
+		},
+	}
+}
+
+// removeFinalizers is a merge patch removing every finalizer
+var removeFinalizers = []byte(`{"metadata":{"finalizers":null}}`)
+
+// deleteLeftover deletes the ConfigMap a previous run of a tutorial left
+// behind, if any. Tutorials that add finalizers can leave one behind if they
+// stop halfway, so finalizers are removed first, otherwise the ConfigMap would
+// never be deleted.
+func deleteLeftover(client generic.ClientInterface[*corev1.ConfigMap, *corev1.ConfigMapList], namespace, name string) {
+	_, err := client.Patch(namespace, name, types.MergePatchType, removeFinalizers)
+	must(ignoreNotFound(err))
+	must(ignoreNotFound(client.Delete(namespace, name, &metav1.DeleteOptions{})))
+}
+
+// waitForDeleted waits until the object is gone from k8s. Deletes aren't
+// always immediate (finalizers, garbage collection), so re-creating an object
+// right after deleting it can fail with AlreadyExists.
+func waitForDeleted(ctx context.Context, ctrl wcorev1.ConfigMapController, namespace, name string) {
+	must(wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, 30*time.Second, true, func(ctx context.Context) (bool, error) {
+		_, err := ctrl.Get(namespace, name, metav1.GetOptions{})
+		if errclass.Classify(err) == errclass.NotFound {
+			return true, nil
+		}
+		return false, err
+	}))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"github.com/tomleb/lasso-controller-notes/patch-vs-update/pkg/patchutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// tutorialEnsure shows the helpers from patchutil, which package the
+// conflict-free patches of tutorialPatch for common mutations.
+//
+// Every call uses the stale ConfigMap returned by Create on purpose: since the
+// patches have no resourceVersion, being stale doesn't matter. Only the
+// finalizer patches would fail, with Invalid, if the finalizers changed since,
+// which they don't here. Calls that have nothing to do don't send any request,
+// which is visible since the rv doesn't change.
+func tutorialEnsure(client generic.ClientInterface[*corev1.ConfigMap, *corev1.ConfigMapList]) {
+	fmt.Println("Ensure tutorial")
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ensure",
+			Namespace: "default",
+			Labels: map[string]string{
+				"app": "tutorial",
+			},
+		},
+		Data: map[string]string{
+			"foo": "bar",
+		},
+	}
+
+	deleteLeftover(client, cm.Namespace, cm.Name)
+
+	stale, err := client.Create(cm)
+	must(err)
+	fmt.Printf("ConfigMap created with rv=%s\n", stale.ResourceVersion)
+
+	show := func(op string, cm *corev1.ConfigMap, err error) {
+		must(err)
+		fmt.Printf("%s: rv=%s,labels=%v,finalizers=%v,data=%v\n", op, cm.ResourceVersion, cm.Labels, cm.Finalizers, cm.Data)
+	}
+
+	result, err := patchutil.EnsureLabel(client, stale, "app", "tutorial")
+	show("EnsureLabel already satisfied", result, err)
+
+	result, err = patchutil.EnsureLabel(client, stale, "tier", "backend")
+	show("EnsureLabel", result, err)
+
+	result, err = patchutil.RemoveLabel(client, stale, "app")
+	show("RemoveLabel", result, err)
+
+	result, err = patchutil.EnsureFinalizer(client, stale, deleteFinalizer)
+	show("EnsureFinalizer", result, err)
+
+	result, err = patchutil.EnsureDataKey(client, stale, "hello", "world")
+	show("EnsureDataKey", result, err)
+
+	// The finalizer is only visible in the latest version, so use it here
+	result, err = patchutil.RemoveFinalizer(client, result, deleteFinalizer)
+	show("RemoveFinalizer", result, err)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"github.com/tomleb/lasso-controller-notes/patch-vs-update/pkg/errclass"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// tutorialJSONPatch shows the following:
+//
+//  1. A JSON patch (RFC 6902) is a list of operations. Besides add/remove/replace,
+//     there's a `test` operation which makes the whole patch fail if the value at
+//     a path isn't what we expect.
+//
+//  2. This gives us optimistic concurrency at the field level. Instead of "only
+//     patch if nobody touched the object" (resourceVersion), we get "only patch if
+//     data.foo is still bar". Other clients can modify other fields without
+//     making our patch fail.
+//
+//  3. When a test fails, k8s returns an Invalid (422) error, NOT a Conflict. So
+//     retry.RetryOnConflict will NOT retry it, which is usually what we want since
+//     the precondition is no longer true.
+func tutorialJSONPatch(client generic.ClientInterface[*corev1.ConfigMap, *corev1.ConfigMapList]) {
+	fmt.Println("JSON patch tutorial")
+	// Setup code where we create a new ConfigMap named "jsonpatch"
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "jsonpatch",
+			Namespace: "default",
+		},
+		Data: map[string]string{
+			"foo": "bar",
+		},
+	}
+
+	err := client.Delete(cm.Namespace, cm.Name, &metav1.DeleteOptions{})
+	must(ignoreNotFound(err))
+
+	cm2, err := client.Create(cm)
+	must(err)
+	fmt.Printf("ConfigMap created with rv=%s,data=%v\n", cm2.ResourceVersion, cm2.Data)
+
+	// Only set data.hello if data.foo == bar. Notice there's no resourceVersion
+	// anywhere in the patch.
+	modified := cm2.DeepCopy()
+	modified.Data["hello"] = "world"
+	patch, err := makeGuardedPatch(cm2, modified, "/data/foo")
+	must(err)
+	cm3, err := client.Patch(cm2.Namespace, cm2.Name, types.JSONPatchType, patch)
+	must(err)
+	fmt.Printf("ConfigMap patched new rv=%s,data=%v\n", cm3.ResourceVersion, cm3.Data)
+
+	// Some other client modifies a field we don't care about. This bumps the RV,
+	// so cm3 is now stale.
+	cm4, err := client.Patch(cm2.Namespace, cm2.Name, types.MergePatchType, []byte(`{"data":{"other":"client"}}`))
+	must(err)
+	fmt.Printf("ConfigMap patched by another client new rv=%s,data=%v\n", cm4.ResourceVersion, cm4.Data)
+
+	// Our patch is built from the stale cm3 but still succeeds, because the
+	// fields it tests haven't changed. With resourceVersion we'd have a conflict.
+	stale := persisted(client, cm3)
+	modified = stale.DeepCopy()
+	modified.Data["hello"] = "toto"
+	patch, err = makeGuardedPatch(stale, modified, "/data/foo")
+	must(err)
+	cm5, err := client.Patch(stale.Namespace, stale.Name, types.JSONPatchType, patch)
+	must(err)
+	fmt.Printf("ConfigMap patched from stale rv=%s, new rv=%s,data=%v\n", stale.ResourceVersion, cm5.ResourceVersion, cm5.Data)
+
+	// Now the other client changes data.foo, which is our precondition
+	_, err = client.Patch(cm2.Namespace, cm2.Name, types.MergePatchType, []byte(`{"data":{"foo":"baz"}}`))
+	must(err)
+
+	// The same kind of patch now fails the test operation
+	latest := persisted(client, cm5)
+	modified = latest.DeepCopy()
+	modified.Data["hello"] = "again"
+	patch, err = makeGuardedPatch(latest, modified, "/data/foo")
+	must(err)
+	_, err = client.Patch(latest.Namespace, latest.Name, types.JSONPatchType, patch)
+	if mustBe(errclass.Invalid, err) {
+		fmt.Printf("ConfigMap not patched because test failed: %v\n", err)
+	}
+}
+
+// jsonPatchOperation is a single RFC 6902 operation.
+//
+// Value is kept as raw JSON so that a `null` value is still serialized. We
+// need it to test that a path doesn't exist.
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// makeGuardedPatch creates a JSON patch that turns original into modified.
+//
+// Every operation is preceded by a `test` operation on the original value of
+// the path it touches, so the patch fails if someone changed one of those fields
+// in the meantime. Added fields are tested against null, which passes only if
+// they don't exist yet.
+//
+// guards are extra JSON pointers (eg: "/data/foo") that aren't modified but
+// must still have the same value as in original for the patch to apply.
+func makeGuardedPatch(original, modified any, guards ...string) ([]byte, error) {
+	originalDoc, err := toJSONDoc(original)
+	if err != nil {
+		return nil, err
+	}
+	modifiedDoc, err := toJSONDoc(modified)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []jsonPatchOperation
+	for _, guard := range guards {
+		value, err := jsonPointerGet(originalDoc, guard)
+		if err != nil {
+			return nil, err
+		}
+		op, err := newJSONPatchOperation("test", guard, value)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+
+	diffOps, err := diffGuarded("", originalDoc, modifiedDoc)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, diffOps...)
+
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("making guarded patch with guards=%v\nPatch: %s\n", guards, string(patch))
+	return patch, nil
+}
+
+func diffGuarded(path string, original, modified any) ([]jsonPatchOperation, error) {
+	originalMap, originalIsMap := original.(map[string]any)
+	modifiedMap, modifiedIsMap := modified.(map[string]any)
+	if !originalIsMap || !modifiedIsMap {
+		if reflect.DeepEqual(original, modified) {
+			return nil, nil
+		}
+		return guardedOperations("replace", path, original, modified)
+	}
+
+	keys := map[string]bool{}
+	for k := range originalMap {
+		keys[k] = true
+	}
+	for k := range modifiedMap {
+		keys[k] = true
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+
+	var ops []jsonPatchOperation
+	for _, k := range sortedKeys {
+		childPath := path + "/" + escapeJSONPointer(k)
+		originalValue, inOriginal := originalMap[k]
+		modifiedValue, inModified := modifiedMap[k]
+
+		var childOps []jsonPatchOperation
+		var err error
+		switch {
+		case !inOriginal:
+			childOps, err = guardedOperations("add", childPath, nil, modifiedValue)
+		case !inModified:
+			childOps, err = guardedOperations("remove", childPath, originalValue, nil)
+		default:
+			childOps, err = diffGuarded(childPath, originalValue, modifiedValue)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, childOps...)
+	}
+	return ops, nil
+}
+
+// guardedOperations returns the test operation followed by the actual operation
+func guardedOperations(op, path string, original, modified any) ([]jsonPatchOperation, error) {
+	test, err := newJSONPatchOperation("test", path, original)
+	if err != nil {
+		return nil, err
+	}
+	if op == "remove" {
+		return []jsonPatchOperation{test, {Op: op, Path: path}}, nil
+	}
+	change, err := newJSONPatchOperation(op, path, modified)
+	if err != nil {
+		return nil, err
+	}
+	return []jsonPatchOperation{test, change}, nil
+}
+
+func newJSONPatchOperation(op, path string, value any) (jsonPatchOperation, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return jsonPatchOperation{}, err
+	}
+	return jsonPatchOperation{Op: op, Path: path, Value: raw}, nil
+}
+
+func toJSONDoc(obj any) (any, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// jsonPointerGet returns the value at the given JSON pointer, or nil if it
+// doesn't exist
+func jsonPointerGet(doc any, pointer string) (any, error) {
+	if pointer == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	current := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		m, ok := current.(map[string]any)
+		if !ok {
+			return nil, nil
+		}
+		current = m[unescapeJSONPointer(token)]
+	}
+	return current, nil
+}
+
+var (
+	jsonPointerEscaper   = strings.NewReplacer("~", "~0", "/", "~1")
+	jsonPointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+)
+
+func escapeJSONPointer(s string) string {
+	return jsonPointerEscaper.Replace(s)
+}
+
+func unescapeJSONPointer(s string) string {
+	return jsonPointerUnescaper.Replace(s)
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"os"
 
@@ -12,8 +13,8 @@ import (
 	"github.com/rancher/wrangler/v3/pkg/generic"
 	"github.com/rancher/wrangler/v3/pkg/kubeconfig"
 	"github.com/rancher/wrangler/v3/pkg/schemes"
+	"github.com/tomleb/lasso-controller-notes/patch-vs-update/pkg/errclass"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -21,6 +22,11 @@ import (
 	"k8s.io/client-go/util/retry"
 )
 
+var (
+	diff   = flag.Bool("diff", false, "Print a field-level diff for every Patch/Update")
+	dryRun = flag.Bool("dry-run", false, "Send every Patch/Update with DryRun: All (implies -diff)")
+)
+
 // This small tutorial attempts to show resourceVersion (RV) conflict checking
 // for both Patch and Update.
 //
@@ -37,7 +43,16 @@ import (
 // need to retry on conflict (and constantly fetch the latest state from k8s)
 //
 // See below for more details.
+//
+// Run with -diff to see what each Patch/Update changed, and with -dry-run to
+// send them with DryRun: All so they aren't persisted. Only Patch/Update are dry
+// run: the setup code of each tutorial still really deletes and creates its
+// ConfigMap, otherwise there'd be nothing to patch. In dry-run mode, the
+// conflicts the tutorials expect don't happen since the previous writes were never
+// persisted.
 func main() {
+	flag.Parse()
+
 	scheme := runtime.NewScheme()
 	utilruntime.Must(schemes.AddToScheme(scheme))
 
@@ -54,12 +69,33 @@ func main() {
 	core, err := core.NewFactoryFromConfigWithOptions(restCfg, opts)
 	must(err)
 
-	configMapCtrl := core.Core().V1().ConfigMap()
+	var configMapCtrl generic.ClientInterface[*corev1.ConfigMap, *corev1.ConfigMapList] = core.Core().V1().ConfigMap()
+	if *diff || *dryRun {
+		lassoClient, err := lassoClientFor(controllerFactory, corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+		must(err)
+		configMapCtrl = newPreviewClient(configMapCtrl, lassoClient, *dryRun)
+	}
+	// The cache must be registered before starting the factory, otherwise there's
+	// nothing to sync. Only UpdateWithRetry and tutorialDelete use it.
+	configMapCache := core.Core().V1().ConfigMap().Cache()
+	ctx := context.Background()
+	must(controllerFactory.Start(ctx, 1))
+
 	// Look at tutorialPatch's comment for more info
 	tutorialPatch(configMapCtrl)
 	fmt.Println("")
+	// Look at tutorialJSONPatch's comment for more info
+	tutorialJSONPatch(configMapCtrl)
+	fmt.Println("")
 	// Look at tutorialUpdate's comment for more info
-	tutorialUpdate(configMapCtrl)
+	tutorialUpdate(configMapCtrl, configMapCache)
+	fmt.Println("")
+	// Look at tutorialEnsure's comment for more info
+	tutorialEnsure(configMapCtrl)
+	fmt.Println("")
+	// Look at tutorialDelete's comment for more info. It doesn't go through
+	// -diff/-dry-run since it only needs to show what Delete does.
+	tutorialDelete(ctx, core.Core().V1().ConfigMap())
 }
 
 // tutorialPatch shows the following:
@@ -118,8 +154,9 @@ func tutorialPatch(client generic.ClientInterface[*corev1.ConfigMap, *corev1.Con
 	patch, err = makePatch(cm, cm2)
 	must(err)
 	_, err = client.Patch(cm2.Namespace, cm2.Name, types.MergePatchType, patch)
-	mustBeConflict(err)
-	fmt.Printf("ConfigMap not patched due to conflict, stale rv=%s\n", cm2.ResourceVersion)
+	if mustBe(errclass.Conflict, err) {
+		fmt.Printf("ConfigMap not patched due to conflict, stale rv=%s\n", cm2.ResourceVersion)
+	}
 
 	// Similar to Update, we can opt-out of conflict checking of RV with Patch
 	// by making sure the resourceVersion is NOT in the patch. There are a few
@@ -157,7 +194,10 @@ func tutorialPatch(client generic.ClientInterface[*corev1.ConfigMap, *corev1.Con
 //     tutorial doesn't go into that).
 //
 //  4. Using retry.RetryOnConflict to retry updates
-func tutorialUpdate(client generic.ClientInterface[*corev1.ConfigMap, *corev1.ConfigMapList]) {
+//
+//  5. Using UpdateWithRetry, which does the same but reads from the cache first
+//     and skips the Update when nothing changed
+func tutorialUpdate(client generic.ClientInterface[*corev1.ConfigMap, *corev1.ConfigMapList], cache generic.CacheInterface[*corev1.ConfigMap]) {
 	fmt.Println("Update tutorial")
 	// Setup code where we create a new ConfigMap named "update"
 	cm := &corev1.ConfigMap{
@@ -197,8 +237,9 @@ func tutorialUpdate(client generic.ClientInterface[*corev1.ConfigMap, *corev1.Co
 	//
 	//     Operation cannot be fulfilled on configmaps "update": the object has been modified; please apply your changes to the latest version and try again
 	_, err = client.Update(cm2)
-	mustBeConflict(err)
-	fmt.Printf("ConfigMap not updated due to conflict, stale rv=%s\n", cm2.ResourceVersion)
+	if mustBe(errclass.Conflict, err) {
+		fmt.Printf("ConfigMap not updated due to conflict, stale rv=%s\n", cm2.ResourceVersion)
+	}
 
 	// We can opt-out of this RV conflict check simply by sending an update with no RV defined
 	cm2.SetResourceVersion("")
@@ -229,6 +270,26 @@ func tutorialUpdate(client generic.ClientInterface[*corev1.ConfigMap, *corev1.Co
 		return nil
 	})
 	must(err)
+
+	// UpdateWithRetry wraps the above. The first attempt uses the cache, which
+	// might be stale, in which case the conflict makes it fall back to a live Get.
+	//
+	// "hello" is already "world", so this one doesn't send any Update, nor any
+	// request at all if the cache has the ConfigMap.
+	result, err := UpdateWithRetry(client, cache, cm.Namespace, cm.Name, func(cm *corev1.ConfigMap) error {
+		cm.Data["hello"] = "world"
+		return nil
+	})
+	must(err)
+	fmt.Printf("ConfigMap UpdateWithRetry attempts=%d updated=%t rv=%s %v\n", result.Attempts, result.Updated, result.Object.ResourceVersion, result.Object.Data)
+
+	// This one does change something, so an Update is sent
+	result, err = UpdateWithRetry(client, cache, cm.Namespace, cm.Name, func(cm *corev1.ConfigMap) error {
+		cm.Data["hello"] = "again"
+		return nil
+	})
+	must(err)
+	fmt.Printf("ConfigMap UpdateWithRetry attempts=%d updated=%t rv=%s %v\n", result.Attempts, result.Updated, result.Object.ResourceVersion, result.Object.Data)
 }
 
 func makePatch(original, modified *corev1.ConfigMap) ([]byte, error) {
@@ -256,20 +317,39 @@ func must(err error) {
 	}
 }
 
-func mustBeConflict(err error) {
-	if apierrors.IsConflict(err) {
-		return
+// mustBe panics unless err is of the given category. It returns false if there
+// was no error because of -dry-run, which makes conflicts disappear.
+func mustBe(category errclass.Category, err error) bool {
+	if errclass.Classify(err) == category {
+		return true
+	}
+
+	if err == nil && *dryRun {
+		fmt.Printf("dry-run: expected %s, got none since previous writes were not persisted\n", category)
+		return false
 	}
 
 	if err != nil {
 		panic(err)
 	}
 
-	panic(errors.New("expected conflict, got no error"))
+	panic(fmt.Errorf("expected %s, got no error", category))
+}
+
+// persisted returns obj, the response of a previous write. In dry-run mode
+// that write was never persisted, so the live object is returned instead,
+// otherwise patches built from obj would test values k8s never had.
+func persisted(client generic.ClientInterface[*corev1.ConfigMap, *corev1.ConfigMapList], obj *corev1.ConfigMap) *corev1.ConfigMap {
+	if !*dryRun {
+		return obj
+	}
+	live, err := client.Get(obj.Namespace, obj.Name, metav1.GetOptions{})
+	must(err)
+	return live
 }
 
 func ignoreNotFound(err error) error {
-	if apierrors.IsNotFound(err) {
+	if errclass.Classify(err) == errclass.NotFound {
 		return nil
 	}
 	return err
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tomleb/lasso-controller-notes/patch-vs-update/pkg/errclass"
+	"github.com/tomleb/lasso-controller-notes/patch-vs-update/pkg/localpatch"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// created returns cm as returned by Create, with the fields the apiserver sets
+// and that end up in makePatch's patches
+func created(cm *corev1.ConfigMap) *corev1.ConfigMap {
+	cm = cm.DeepCopy()
+	now := metav1.NewTime(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	cm.UID = "4f1c3e1a-8a6f-4a3e-9c1b-6b0e3b9d6f2a"
+	cm.ResourceVersion = "1"
+	cm.CreationTimestamp = now
+	cm.ManagedFields = []metav1.ManagedFieldsEntry{{
+		Manager:    "patch-vs-update",
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		APIVersion: "v1",
+		Time:       &now,
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:data":{".":{},"f:foo":{}}}`)},
+	}}
+	return cm
+}
+
+// apply applies patch to current like the apiserver would
+func apply(t *testing.T, current *corev1.ConfigMap, pt types.PatchType, patch []byte) (*corev1.ConfigMap, error) {
+	t.Helper()
+	result := &corev1.ConfigMap{}
+	if err := localpatch.Apply(current, pt, patch, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func assertPatched(t *testing.T, err error, want errclass.Category) {
+	t.Helper()
+	if got := errclass.Classify(err); got != want {
+		t.Fatalf("patch error = %v (%s), want %s", err, got, want)
+	}
+}
+
+// TestTutorialPatch follows tutorialPatch
+func TestTutorialPatch(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "patch", Namespace: "default"},
+		Data:       map[string]string{"foo": "bar"},
+	}
+	cm2 := created(cm)
+	cm2.Data["hello"] = "world"
+
+	// The patch has the rv of cm2, along with its uid, creationTimestamp and
+	// managedFields since cm has none
+	patch, err := makePatch(cm, cm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm3, err := apply(t, created(cm), types.MergePatchType, patch)
+	assertPatched(t, err, errclass.None)
+	if want := map[string]string{"foo": "bar", "hello": "world"}; !reflect.DeepEqual(cm3.Data, want) {
+		t.Errorf("data = %v, want %v", cm3.Data, want)
+	}
+	if cm3.UID != cm2.UID {
+		t.Errorf("uid = %s, want %s", cm3.UID, cm2.UID)
+	}
+
+	// The same patch is now stale
+	_, err = apply(t, cm3, types.MergePatchType, patch)
+	assertPatched(t, err, errclass.Conflict)
+
+	// A patch between two versions of the same object has no rv, so being
+	// stale doesn't matter
+	modified := cm2.DeepCopy()
+	modified.Data["hello"] = "toto"
+	patch, err = makePatch(cm2, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm4, err := apply(t, cm3, types.MergePatchType, patch)
+	assertPatched(t, err, errclass.None)
+	if want := map[string]string{"foo": "bar", "hello": "toto"}; !reflect.DeepEqual(cm4.Data, want) {
+		t.Errorf("data = %v, want %v", cm4.Data, want)
+	}
+}
+
+// TestTutorialJSONPatch follows tutorialJSONPatch
+func TestTutorialJSONPatch(t *testing.T) {
+	cm2 := created(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "jsonpatch", Namespace: "default"},
+		Data:       map[string]string{"foo": "bar"},
+	})
+
+	modified := cm2.DeepCopy()
+	modified.Data["hello"] = "world"
+	patch, err := makeGuardedPatch(cm2, modified, "/data/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm3, err := apply(t, cm2, types.JSONPatchType, patch)
+	assertPatched(t, err, errclass.None)
+
+	// Another client modifies a field the patches don't test
+	cm4, err := apply(t, cm3, types.MergePatchType, []byte(`{"data":{"other":"client"}}`))
+	assertPatched(t, err, errclass.None)
+
+	// A patch built from the stale cm3 still applies
+	modified = cm3.DeepCopy()
+	modified.Data["hello"] = "toto"
+	patch, err = makeGuardedPatch(cm3, modified, "/data/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm5, err := apply(t, cm4, types.JSONPatchType, patch)
+	assertPatched(t, err, errclass.None)
+	if want := map[string]string{"foo": "bar", "hello": "toto", "other": "client"}; !reflect.DeepEqual(cm5.Data, want) {
+		t.Errorf("data = %v, want %v", cm5.Data, want)
+	}
+
+	// Until the other client changes data.foo, which the patches test
+	cm6, err := apply(t, cm5, types.MergePatchType, []byte(`{"data":{"foo":"baz"}}`))
+	assertPatched(t, err, errclass.None)
+
+	modified = cm5.DeepCopy()
+	modified.Data["hello"] = "again"
+	patch, err = makeGuardedPatch(cm5, modified, "/data/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = apply(t, cm6, types.JSONPatchType, patch)
+	assertPatched(t, err, errclass.Invalid)
+}
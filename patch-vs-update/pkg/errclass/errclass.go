@@ -0,0 +1,177 @@
+// Package errclass classifies errors returned by the k8s API into a small set of
+// categories, and maps those categories to what a caller should do about them:
+// retry, skip or fail.
+//
+// The idea is that handlers and the tutorials share the same Policy instead of
+// sprinkling apierrors.IsXXX checks everywhere.
+package errclass
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Category is the kind of API error
+type Category string
+
+const (
+	None          Category = "None"
+	Conflict      Category = "Conflict"
+	NotFound      Category = "NotFound"
+	AlreadyExists Category = "AlreadyExists"
+	Invalid       Category = "Invalid"
+	Forbidden     Category = "Forbidden"
+	Throttled     Category = "Throttled"
+	Timeout       Category = "Timeout"
+	WebhookDenied Category = "WebhookDenied"
+	Unknown       Category = "Unknown"
+)
+
+// Decision is what the caller should do with an error
+type Decision string
+
+const (
+	// Retry means the same request might succeed later
+	Retry Decision = "Retry"
+	// Skip means the error can be ignored, eg: deleting something that's already gone
+	Skip Decision = "Skip"
+	// Fail means retrying won't help
+	Fail Decision = "Fail"
+)
+
+// Classify returns the category of err. A nil error is None.
+//
+// Webhook denials are checked first because webhooks can deny with any status
+// code, so they would otherwise be reported as Forbidden or Invalid.
+func Classify(err error) Category {
+	switch {
+	case err == nil:
+		return None
+	case isWebhookDenied(err):
+		return WebhookDenied
+	case apierrors.IsConflict(err):
+		return Conflict
+	case apierrors.IsNotFound(err):
+		return NotFound
+	case apierrors.IsAlreadyExists(err):
+		return AlreadyExists
+	case apierrors.IsInvalid(err):
+		return Invalid
+	case apierrors.IsForbidden(err):
+		return Forbidden
+	case apierrors.IsTooManyRequests(err):
+		return Throttled
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return Timeout
+	}
+	return Unknown
+}
+
+func isWebhookDenied(err error) bool {
+	var statusErr apierrors.APIStatus
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	msg := statusErr.Status().Message
+	return strings.HasPrefix(msg, "admission webhook") && strings.Contains(msg, "denied the request")
+}
+
+// Policy maps categories to decisions. Categories missing from the map are
+// treated as Fail.
+type Policy map[Category]Decision
+
+// DefaultPolicy is the policy we recommend for controllers:
+//
+//   - Conflicts, throttling and timeouts are transient, so retry.
+//   - NotFound and AlreadyExists usually mean the desired state is already reached
+//     (deleting something deleted, creating something created), so skip.
+//   - Everything else won't fix itself by retrying right away.
+var DefaultPolicy = Policy{
+	None:          Skip,
+	Conflict:      Retry,
+	NotFound:      Skip,
+	AlreadyExists: Skip,
+	Invalid:       Fail,
+	Forbidden:     Fail,
+	Throttled:     Retry,
+	Timeout:       Retry,
+	WebhookDenied: Fail,
+	Unknown:       Fail,
+}
+
+// With returns a copy of the policy with the given category overridden
+func (p Policy) With(category Category, decision Decision) Policy {
+	result := make(Policy, len(p)+1)
+	for k, v := range p {
+		result[k] = v
+	}
+	result[category] = decision
+	return result
+}
+
+// Decide returns what to do with err
+func (p Policy) Decide(err error) Decision {
+	if decision, ok := p[Classify(err)]; ok {
+		return decision
+	}
+	return Fail
+}
+
+// Retriable can be passed to retry.OnError, prefer Retry which honours
+// Retry-After
+func (p Policy) Retriable(err error) bool {
+	return p.Decide(err) == Retry
+}
+
+// Filter returns nil if err should be skipped, err otherwise. Eg: the
+// tutorials' ignoreNotFound is DefaultPolicy.Filter for NotFound errors.
+func (p Policy) Filter(err error) error {
+	if err == nil || p.Decide(err) == Skip {
+		return nil
+	}
+	return err
+}
+
+// DefaultBackoff is meant for Policy.Retry. retry.DefaultBackoff gives up after
+// about 50ms in total, which is fine for conflicts but not for throttling, where
+// the apiserver usually asks to wait at least a second.
+var DefaultBackoff = wait.Backoff{
+	Steps:    8,
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Cap:      10 * time.Second,
+}
+
+// Retry calls fn until it succeeds, backoff is exhausted or the policy doesn't
+// say Retry for its error. It's retry.OnError, except that it waits as long as
+// the apiserver suggests (Retry-After) if that's longer than backoff.
+func (p Policy) Retry(backoff wait.Backoff, fn func() error) error {
+	for {
+		err := fn()
+		if err == nil || !p.Retriable(err) || backoff.Steps <= 1 {
+			return err
+		}
+		time.Sleep(Delay(err, backoff.Step()))
+	}
+}
+
+// Delay returns how long to wait before retrying after err: delay, or the delay
+// suggested by the apiserver if it's longer, eg: the Retry-After of a 429
+func Delay(err error, delay time.Duration) time.Duration {
+	if seconds, ok := apierrors.SuggestsClientDelay(err); ok {
+		if suggested := time.Duration(seconds) * time.Second; suggested > delay {
+			return suggested
+		}
+	}
+	return delay
+}
+
+// OnError is Retry, and the final error is dropped if the policy says Skip
+func (p Policy) OnError(backoff wait.Backoff, fn func() error) error {
+	return p.Filter(p.Retry(backoff, fn))
+}
@@ -0,0 +1,126 @@
+package errclass
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var configMaps = schema.GroupResource{Resource: "configmaps"}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Category
+	}{
+		{name: "nil", err: nil, want: None},
+		{name: "conflict", err: apierrors.NewConflict(configMaps, "foo", errors.New("stale")), want: Conflict},
+		{name: "not found", err: apierrors.NewNotFound(configMaps, "foo"), want: NotFound},
+		{name: "already exists", err: apierrors.NewAlreadyExists(configMaps, "foo"), want: AlreadyExists},
+		{
+			name: "invalid",
+			err:  apierrors.NewInvalid(schema.GroupKind{Kind: "ConfigMap"}, "foo", field.ErrorList{field.Required(field.NewPath("data"), "")}),
+			want: Invalid,
+		},
+		{name: "forbidden", err: apierrors.NewForbidden(configMaps, "foo", errors.New("nope")), want: Forbidden},
+		{name: "too many requests", err: apierrors.NewTooManyRequests("slow down", 1), want: Throttled},
+		{name: "timeout", err: apierrors.NewTimeoutError("took too long", 1), want: Timeout},
+		{name: "server timeout", err: apierrors.NewServerTimeout(configMaps, "get", 1), want: Timeout},
+		{name: "webhook denied with forbidden", err: webhookDenied(http.StatusForbidden, metav1.StatusReasonForbidden), want: WebhookDenied},
+		{name: "webhook denied with invalid", err: webhookDenied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid), want: WebhookDenied},
+		{name: "wrapped", err: fmt.Errorf("updating: %w", apierrors.NewConflict(configMaps, "foo", errors.New("stale"))), want: Conflict},
+		{name: "internal error", err: apierrors.NewInternalError(errors.New("boom")), want: Unknown},
+		{name: "not an api error", err: errors.New("boom"), want: Unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Errorf("Classify() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// webhookDenied returns the error the apiserver returns when a webhook denies a
+// request with the given code and reason
+func webhookDenied(code int32, reason metav1.StatusReason) error {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    code,
+		Reason:  reason,
+		Message: `admission webhook "validate.example.com" denied the request: nope`,
+	}}
+}
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		delay time.Duration
+		want  time.Duration
+	}{
+		{name: "no suggestion", err: apierrors.NewConflict(configMaps, "foo", errors.New("stale")), delay: time.Second, want: time.Second},
+		{name: "longer suggestion", err: apierrors.NewTooManyRequests("slow down", 3), delay: time.Second, want: 3 * time.Second},
+		{name: "shorter suggestion", err: apierrors.NewTooManyRequests("slow down", 1), delay: 5 * time.Second, want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Delay(tt.err, tt.delay); got != tt.want {
+				t.Errorf("Delay() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	backoff := wait.Backoff{Steps: 3, Duration: time.Millisecond}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   Category
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1, wantErr: None},
+		{
+			name:      "retried until success",
+			errs:      []error{apierrors.NewConflict(configMaps, "foo", errors.New("stale")), nil},
+			wantCalls: 2,
+			wantErr:   None,
+		},
+		{
+			name: "backoff exhausted",
+			errs: []error{
+				apierrors.NewConflict(configMaps, "foo", errors.New("stale")),
+				apierrors.NewConflict(configMaps, "foo", errors.New("stale")),
+				apierrors.NewConflict(configMaps, "foo", errors.New("stale")),
+			},
+			wantCalls: 3,
+			wantErr:   Conflict,
+		},
+		{name: "not retriable", errs: []error{apierrors.NewNotFound(configMaps, "foo")}, wantCalls: 1, wantErr: NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := DefaultPolicy.Retry(backoff, func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if got := Classify(err); got != tt.wantErr {
+				t.Errorf("Retry() error = %s, want %s", got, tt.wantErr)
+			}
+		})
+	}
+}
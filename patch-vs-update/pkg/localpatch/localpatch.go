@@ -0,0 +1,88 @@
+// Package localpatch applies patches to in-memory objects, without a cluster,
+// the same way the k8s apiserver would.
+//
+// It uses the same libraries as the apiserver: gopkg.in/evanphx/json-patch.v4
+// for merge and JSON patches, and apimachinery's strategicpatch for strategic
+// merge patches. It also reproduces the resourceVersion handling of the
+// apiserver: if the patched object ends up with a resourceVersion different
+// from the current one, the patch fails with a conflict. A patch removing the
+// resourceVersion, eg: setting it to null, makes the write unconditional.
+//
+// Server-side apply is not supported, it needs the schema of the object and
+// the managedFields machinery.
+package localpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// Apply applies patch to current and stores the patched object in result.
+//
+// current is never modified. On success, result has its resourceVersion bumped,
+// like it would be by the apiserver. resourceVersions must be integers for
+// this to work, which is the case for objects returned by the apiserver.
+func Apply(current runtime.Object, pt types.PatchType, patch []byte, result runtime.Object) error {
+	currentMeta, err := meta.Accessor(current)
+	if err != nil {
+		return err
+	}
+
+	currentJSON, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	var patchedJSON []byte
+	switch pt {
+	case types.MergePatchType:
+		patchedJSON, err = jsonpatch.MergePatch(currentJSON, patch)
+	case types.JSONPatchType:
+		var decoded jsonpatch.Patch
+		decoded, err = jsonpatch.DecodePatch(patch)
+		if err == nil {
+			patchedJSON, err = decoded.Apply(currentJSON)
+		}
+	case types.StrategicMergePatchType:
+		patchedJSON, err = strategicpatch.StrategicMergePatch(currentJSON, patch, current)
+	default:
+		return fmt.Errorf("unsupported patch type %q", pt)
+	}
+	if err != nil {
+		// The apiserver returns 422 for patches that fail to apply, eg: a
+		// failed JSON patch test operation
+		return apierrors.NewGenericServerResponse(http.StatusUnprocessableEntity, "", schema.GroupResource{}, "", err.Error(), 0, false)
+	}
+
+	if err := json.Unmarshal(patchedJSON, result); err != nil {
+		return err
+	}
+	resultMeta, err := meta.Accessor(result)
+	if err != nil {
+		return err
+	}
+
+	// The patched object is then sent as an update. If the patch set a
+	// resourceVersion, it is used as a precondition. Without one, the update
+	// is unconditional, like an Update without resourceVersion.
+	if rv := resultMeta.GetResourceVersion(); rv != "" && rv != currentMeta.GetResourceVersion() {
+		return apierrors.NewConflict(schema.GroupResource{}, currentMeta.GetName(), fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+
+	rv, err := strconv.Atoi(currentMeta.GetResourceVersion())
+	if err != nil {
+		return fmt.Errorf("invalid resourceVersion %q: %w", currentMeta.GetResourceVersion(), err)
+	}
+	resultMeta.SetResourceVersion(strconv.Itoa(rv + 1))
+	return nil
+}
@@ -0,0 +1,147 @@
+package localpatch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tomleb/lasso-controller-notes/patch-vs-update/pkg/errclass"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// configMap returns the ConfigMap as it would be stored by k8s
+func configMap(rv string, data map[string]string, finalizers ...string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "patch",
+			Namespace:       "default",
+			ResourceVersion: rv,
+			Finalizers:      finalizers,
+		},
+		Data: data,
+	}
+}
+
+// The patches are the ones the tutorials send, eg: makePatch(cm, cm2) in
+// tutorialPatch
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		current *corev1.ConfigMap
+		pt      types.PatchType
+		patch   string
+
+		wantErr        errclass.Category
+		wantData       map[string]string
+		wantFinalizers []string
+	}{
+		{
+			name:     "merge patch with up-to-date rv",
+			current:  configMap("1", map[string]string{"foo": "bar"}),
+			pt:       types.MergePatchType,
+			patch:    `{"data":{"hello":"world"},"metadata":{"resourceVersion":"1"}}`,
+			wantErr:  errclass.None,
+			wantData: map[string]string{"foo": "bar", "hello": "world"},
+		},
+		{
+			name:    "merge patch with stale rv",
+			current: configMap("2", map[string]string{"foo": "bar", "hello": "world"}),
+			pt:      types.MergePatchType,
+			patch:   `{"data":{"hello":"world"},"metadata":{"resourceVersion":"1"}}`,
+			wantErr: errclass.Conflict,
+		},
+		{
+			name:     "merge patch without rv from a stale object",
+			current:  configMap("2", map[string]string{"foo": "bar", "hello": "world"}),
+			pt:       types.MergePatchType,
+			patch:    `{"data":{"hello":"toto"}}`,
+			wantErr:  errclass.None,
+			wantData: map[string]string{"foo": "bar", "hello": "toto"},
+		},
+		{
+			name:     "merge patch with null rv is unconditional",
+			current:  configMap("2", map[string]string{"foo": "bar"}),
+			pt:       types.MergePatchType,
+			patch:    `{"data":{"hello":"world"},"metadata":{"resourceVersion":null}}`,
+			wantErr:  errclass.None,
+			wantData: map[string]string{"foo": "bar", "hello": "world"},
+		},
+		{
+			name:     "merge patch with null removes the key",
+			current:  configMap("2", map[string]string{"foo": "bar", "hello": "world"}),
+			pt:       types.MergePatchType,
+			patch:    `{"data":{"hello":null}}`,
+			wantErr:  errclass.None,
+			wantData: map[string]string{"foo": "bar"},
+		},
+		{
+			name:    "guarded JSON patch from a stale object",
+			current: configMap("3", map[string]string{"foo": "bar", "hello": "world", "other": "client"}),
+			pt:      types.JSONPatchType,
+			patch: `[{"op":"test","path":"/data/foo","value":"bar"},` +
+				`{"op":"test","path":"/data/hello","value":"world"},` +
+				`{"op":"replace","path":"/data/hello","value":"toto"}]`,
+			wantErr:  errclass.None,
+			wantData: map[string]string{"foo": "bar", "hello": "toto", "other": "client"},
+		},
+		{
+			name:    "guarded JSON patch with failed test",
+			current: configMap("3", map[string]string{"foo": "baz", "hello": "world"}),
+			pt:      types.JSONPatchType,
+			patch: `[{"op":"test","path":"/data/foo","value":"bar"},` +
+				`{"op":"test","path":"/data/hello","value":"world"},` +
+				`{"op":"replace","path":"/data/hello","value":"toto"}]`,
+			wantErr: errclass.Invalid,
+		},
+		{
+			name:           "merge patch replaces lists",
+			current:        configMap("1", map[string]string{"foo": "bar"}, "a"),
+			pt:             types.MergePatchType,
+			patch:          `{"metadata":{"finalizers":["b"]}}`,
+			wantErr:        errclass.None,
+			wantData:       map[string]string{"foo": "bar"},
+			wantFinalizers: []string{"b"},
+		},
+		{
+			name:     "strategic merge patch merges finalizers",
+			current:  configMap("1", map[string]string{"foo": "bar"}, "a"),
+			pt:       types.StrategicMergePatchType,
+			patch:    `{"metadata":{"finalizers":["b"]}}`,
+			wantErr:  errclass.None,
+			wantData: map[string]string{"foo": "bar"},
+			// Items from the patch come first, same as on a real cluster
+			wantFinalizers: []string{"b", "a"},
+		},
+		{
+			name:    "guarded finalizer append with a stale list",
+			current: configMap("2", map[string]string{"foo": "bar"}, "a", "b"),
+			pt:      types.JSONPatchType,
+			patch: `[{"op":"test","path":"/metadata/finalizers","value":["a"]},` +
+				`{"op":"add","path":"/metadata/finalizers/-","value":"b"}]`,
+			wantErr: errclass.Invalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &corev1.ConfigMap{}
+			err := Apply(tt.current, tt.pt, []byte(tt.patch), result)
+			if got := errclass.Classify(err); got != tt.wantErr {
+				t.Fatalf("Apply() error = %v (%s), want %s", err, got, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(result.Data, tt.wantData) {
+				t.Errorf("data = %v, want %v", result.Data, tt.wantData)
+			}
+			if !reflect.DeepEqual(result.Finalizers, tt.wantFinalizers) {
+				t.Errorf("finalizers = %v, want %v", result.Finalizers, tt.wantFinalizers)
+			}
+			if result.ResourceVersion == tt.current.ResourceVersion {
+				t.Errorf("rv = %s, want it bumped", result.ResourceVersion)
+			}
+		})
+	}
+}
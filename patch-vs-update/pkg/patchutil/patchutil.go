@@ -0,0 +1,167 @@
+// Package patchutil has helpers to ensure small things about an object (a
+// label, a finalizer, a data key...) using the smallest possible patch.
+//
+// They follow the approach recommended in tutorialPatch: the patches never
+// contain a resourceVersion, so they can't fail with a conflict. When the object
+// already satisfies what is asked, no request is sent at all and the object is
+// returned as-is.
+//
+// The label, annotation and data helpers can be computed from a stale object,
+// eg: one coming from a cache, since they only touch their own key. The
+// finalizer helpers can't: finalizers are a list, so their patches test the
+// list they were computed from and fail with an Invalid error if it changed
+// since. Read the object again and retry in that case.
+package patchutil
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// EnsureLabel sets the label key to value
+func EnsureLabel[T generic.RuntimeMetaObject, TList runtime.Object](client generic.ClientInterface[T, TList], obj T, key, value string) (T, error) {
+	if current, ok := obj.GetLabels()[key]; ok && current == value {
+		return obj, nil
+	}
+	return mergePatchMetadata(client, obj, "labels", key, value)
+}
+
+// RemoveLabel removes the label key
+func RemoveLabel[T generic.RuntimeMetaObject, TList runtime.Object](client generic.ClientInterface[T, TList], obj T, key string) (T, error) {
+	if _, ok := obj.GetLabels()[key]; !ok {
+		return obj, nil
+	}
+	return mergePatchMetadata(client, obj, "labels", key, nil)
+}
+
+// EnsureAnnotation sets the annotation key to value
+func EnsureAnnotation[T generic.RuntimeMetaObject, TList runtime.Object](client generic.ClientInterface[T, TList], obj T, key, value string) (T, error) {
+	if current, ok := obj.GetAnnotations()[key]; ok && current == value {
+		return obj, nil
+	}
+	return mergePatchMetadata(client, obj, "annotations", key, value)
+}
+
+// RemoveAnnotation removes the annotation key
+func RemoveAnnotation[T generic.RuntimeMetaObject, TList runtime.Object](client generic.ClientInterface[T, TList], obj T, key string) (T, error) {
+	if _, ok := obj.GetAnnotations()[key]; !ok {
+		return obj, nil
+	}
+	return mergePatchMetadata(client, obj, "annotations", key, nil)
+}
+
+// mergePatchMetadata sets (or removes, if value is nil) a single key of a map
+// in metadata, leaving the other keys untouched
+func mergePatchMetadata[T generic.RuntimeMetaObject, TList runtime.Object](client generic.ClientInterface[T, TList], obj T, field, key string, value any) (T, error) {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			field: map[string]any{
+				key: value,
+			},
+		},
+	})
+	if err != nil {
+		return obj, err
+	}
+	return client.Patch(obj.GetNamespace(), obj.GetName(), types.MergePatchType, patch)
+}
+
+// jsonPatchOperation is a single RFC 6902 operation
+type jsonPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// EnsureFinalizer adds the finalizer if it's missing.
+//
+// Finalizers are a list, and a merge patch replaces lists entirely, which
+// could drop finalizers added by others since obj was read. Instead, this
+// sends a JSON patch appending to the list, guarded by a test that the list is
+// still the one of obj. Otherwise, if obj is stale and someone else added the
+// same finalizer in the meantime, it'd be added twice.
+func EnsureFinalizer[T generic.RuntimeMetaObject, TList runtime.Object](client generic.ClientInterface[T, TList], obj T, finalizer string) (T, error) {
+	finalizers := obj.GetFinalizers()
+	for _, f := range finalizers {
+		if f == finalizer {
+			return obj, nil
+		}
+	}
+
+	var ops []jsonPatchOperation
+	if len(finalizers) == 0 {
+		// "-" only works on an existing list. The test makes sure nobody
+		// created the list in the meantime, otherwise we'd overwrite it.
+		ops = []jsonPatchOperation{
+			{Op: "test", Path: "/metadata/finalizers", Value: nil},
+			{Op: "add", Path: "/metadata/finalizers", Value: []string{finalizer}},
+		}
+	} else {
+		ops = []jsonPatchOperation{
+			{Op: "test", Path: "/metadata/finalizers", Value: finalizers},
+			{Op: "add", Path: "/metadata/finalizers/-", Value: finalizer},
+		}
+	}
+	return jsonPatch(client, obj, ops)
+}
+
+// RemoveFinalizer removes the finalizer if it's present.
+//
+// JSON patch can only remove list items by index, so the removal is guarded by
+// a test on that index. If obj is stale and the finalizer moved, the patch fails
+// with an Invalid error instead of removing someone else's finalizer.
+func RemoveFinalizer[T generic.RuntimeMetaObject, TList runtime.Object](client generic.ClientInterface[T, TList], obj T, finalizer string) (T, error) {
+	for i, f := range obj.GetFinalizers() {
+		if f != finalizer {
+			continue
+		}
+		path := fmt.Sprintf("/metadata/finalizers/%d", i)
+		return jsonPatch(client, obj, []jsonPatchOperation{
+			{Op: "test", Path: path, Value: finalizer},
+			{Op: "remove", Path: path},
+		})
+	}
+	return obj, nil
+}
+
+func jsonPatch[T generic.RuntimeMetaObject, TList runtime.Object](client generic.ClientInterface[T, TList], obj T, ops []jsonPatchOperation) (T, error) {
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return obj, err
+	}
+	return client.Patch(obj.GetNamespace(), obj.GetName(), types.JSONPatchType, patch)
+}
+
+// EnsureDataKey sets .data[key] of a ConfigMap
+func EnsureDataKey(client generic.ClientInterface[*corev1.ConfigMap, *corev1.ConfigMapList], obj *corev1.ConfigMap, key, value string) (*corev1.ConfigMap, error) {
+	if current, ok := obj.Data[key]; ok && current == value {
+		return obj, nil
+	}
+	return mergePatchData(client, obj, key, value)
+}
+
+// EnsureSecretDataKey sets .data[key] of a Secret
+func EnsureSecretDataKey(client generic.ClientInterface[*corev1.Secret, *corev1.SecretList], obj *corev1.Secret, key string, value []byte) (*corev1.Secret, error) {
+	if current, ok := obj.Data[key]; ok && string(current) == string(value) {
+		return obj, nil
+	}
+	// []byte is marshalled as base64, which is what Secret's data expects
+	return mergePatchData(client, obj, key, value)
+}
+
+func mergePatchData[T generic.RuntimeMetaObject, TList runtime.Object](client generic.ClientInterface[T, TList], obj T, key string, value any) (T, error) {
+	patch, err := json.Marshal(map[string]any{
+		"data": map[string]any{
+			key: value,
+		},
+	})
+	if err != nil {
+		return obj, err
+	}
+	return client.Patch(obj.GetNamespace(), obj.GetName(), types.MergePatchType, patch)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/rancher/lasso/pkg/client"
+	"github.com/rancher/lasso/pkg/controller"
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// previewClient wraps a wrangler client so that every Update and Patch:
+//
+//  1. prints a field-level diff between the object as it is in k8s right before
+//     the call and the object returned by k8s
+//  2. optionally, is sent with DryRun: All so that nothing is persisted
+//
+// Update and Patch go through a lasso client, see lassoClientFor. Everything else
+// (Create, Delete, Get, etc) goes to the wrapped client untouched, so the
+// tutorials' setup code still works in dry-run mode. It does mean that setup code
+// really writes to the cluster, even in dry-run mode.
+type previewClient[T generic.RuntimeMetaObject, TList runtime.Object] struct {
+	generic.ClientInterface[T, TList]
+
+	client *client.Client
+	dryRun bool
+	out    io.Writer
+}
+
+// lassoClientFor returns the lasso client of gvk. wrangler's generic clients
+// don't take Update/Patch options (DryRun, FieldManager...), lasso's do.
+func lassoClientFor(factory controller.SharedControllerFactory, gvk schema.GroupVersionKind) (*client.Client, error) {
+	return factory.SharedCacheFactory().SharedClientFactory().ForKind(gvk)
+}
+
+func newPreviewClient[T generic.RuntimeMetaObject, TList runtime.Object](wrapped generic.ClientInterface[T, TList], lassoClient *client.Client, dryRun bool) *previewClient[T, TList] {
+	return &previewClient[T, TList]{
+		ClientInterface: wrapped,
+		client:          lassoClient,
+		dryRun:          dryRun,
+		out:             os.Stdout,
+	}
+}
+
+func (p *previewClient[T, TList]) Update(obj T) (T, error) {
+	before := p.before(obj.GetNamespace(), obj.GetName())
+	result := p.newObject()
+	opts := metav1.UpdateOptions{}
+	if p.dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+	err := p.client.Update(context.TODO(), obj.GetNamespace(), obj, result, opts)
+	p.printDiff("Update", obj.GetNamespace(), obj.GetName(), before, result, err)
+	return result, err
+}
+
+func (p *previewClient[T, TList]) Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (T, error) {
+	before := p.before(namespace, name)
+	result := p.newObject()
+	opts := metav1.PatchOptions{}
+	if p.dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+	err := p.client.Patch(context.TODO(), namespace, name, pt, data, result, opts, subresources...)
+	p.printDiff("Patch", namespace, name, before, result, err)
+	return result, err
+}
+
+// before fetches the current object. Getting it from the wrapped client
+// means we see what k8s has, not what the caller thinks k8s has.
+func (p *previewClient[T, TList]) before(namespace, name string) T {
+	obj, err := p.ClientInterface.Get(namespace, name, metav1.GetOptions{})
+	if err != nil {
+		fmt.Fprintf(p.out, "preview: unable to get %s/%s before the call: %v\n", namespace, name, err)
+	}
+	return obj
+}
+
+func (p *previewClient[T, TList]) newObject() T {
+	var zero T
+	return reflect.New(reflect.TypeOf(zero).Elem()).Interface().(T)
+}
+
+func (p *previewClient[T, TList]) printDiff(verb, namespace, name string, before, after T, err error) {
+	mode := ""
+	if p.dryRun {
+		mode = " (dry-run)"
+	}
+	if err != nil {
+		fmt.Fprintf(p.out, "%s %s/%s%s failed: %v\n", verb, namespace, name, mode, err)
+		return
+	}
+	fmt.Fprintf(p.out, "%s %s/%s%s diff:\n", verb, namespace, name, mode)
+	if err := writeDiff(p.out, before, after); err != nil {
+		fmt.Fprintf(p.out, "preview: unable to diff: %v\n", err)
+	}
+}
+
+const (
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// diffIgnoredPaths are not interesting for the tutorials and change on
+// every single write
+var diffIgnoredPaths = []string{
+	"/metadata/managedFields",
+}
+
+// writeDiff writes one line per leaf field that differs between before and
+// after. Lines are coloured unless NO_COLOR is set.
+func writeDiff(w io.Writer, before, after any) error {
+	beforeDoc, err := toJSONDoc(before)
+	if err != nil {
+		return err
+	}
+	afterDoc, err := toJSONDoc(after)
+	if err != nil {
+		return err
+	}
+
+	beforeFields := map[string]string{}
+	flattenJSON("", beforeDoc, beforeFields)
+	afterFields := map[string]string{}
+	flattenJSON("", afterDoc, afterFields)
+
+	paths := map[string]bool{}
+	for path := range beforeFields {
+		paths[path] = true
+	}
+	for path := range afterFields {
+		paths[path] = true
+	}
+	sortedPaths := make([]string, 0, len(paths))
+	for path := range paths {
+		if !isDiffIgnored(path) {
+			sortedPaths = append(sortedPaths, path)
+		}
+	}
+	sort.Strings(sortedPaths)
+
+	_, noColor := os.LookupEnv("NO_COLOR")
+	colorize := func(color, line string) string {
+		if noColor {
+			return line
+		}
+		return color + line + colorReset
+	}
+
+	changed := false
+	for _, path := range sortedPaths {
+		beforeValue, inBefore := beforeFields[path]
+		afterValue, inAfter := afterFields[path]
+		var line string
+		switch {
+		case !inBefore:
+			line = colorize(colorGreen, fmt.Sprintf("  + %s: %s", path, afterValue))
+		case !inAfter:
+			line = colorize(colorRed, fmt.Sprintf("  - %s: %s", path, beforeValue))
+		case beforeValue != afterValue:
+			line = colorize(colorYellow, fmt.Sprintf("  ~ %s: %s -> %s", path, beforeValue, afterValue))
+		default:
+			continue
+		}
+		changed = true
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	if !changed {
+		_, err := fmt.Fprintln(w, "  (no changes)")
+		return err
+	}
+	return nil
+}
+
+// flattenJSON stores every leaf of doc in fields, keyed by its JSON pointer.
+// Arrays are treated as leaves, which is good enough to see what changed.
+func flattenJSON(path string, doc any, fields map[string]string) {
+	if m, ok := doc.(map[string]any); ok && len(m) > 0 {
+		for k, v := range m {
+			flattenJSON(path+"/"+escapeJSONPointer(k), v, fields)
+		}
+		return
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		fields[path] = fmt.Sprintf("%v", doc)
+		return
+	}
+	fields[path] = string(data)
+}
+
+func isDiffIgnored(path string) bool {
+	for _, ignored := range diffIgnoredPaths {
+		if path == ignored || strings.HasPrefix(path, ignored+"/") {
+			return true
+		}
+	}
+	return false
+}
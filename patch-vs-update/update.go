@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"github.com/tomleb/lasso-controller-notes/patch-vs-update/pkg/errclass"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// UpdateResult describes what UpdateWithRetry ended up doing.
+type UpdateResult[T generic.RuntimeMetaObject] struct {
+	// Object is the latest version of the object we know about. It is the
+	// response of the Update call if one was made, otherwise the object
+	// that mutate was run against.
+	Object T
+	// Attempts is the number of times mutate was called.
+	Attempts int
+	// Updated is true if an Update call was actually sent to k8s.
+	Updated bool
+}
+
+// UpdateWithRetry is the retry.RetryOnConflict pattern from tutorialUpdate
+// packaged up so handlers don't need to copy-paste it.
+//
+// The main differences with the tutorial:
+//
+//  1. The first attempt reads from the cache instead of doing a live Get. The cache
+//     is very often up-to-date, so this saves one round trip to k8s in the common
+//     case. If the cache is stale we get a conflict, and all following attempts
+//     read from k8s directly.
+//
+//  2. mutate always receives a copy, so it's safe to modify the object even when
+//     it comes from the cache.
+//
+//  3. If mutate doesn't change anything, we don't send an Update at all. No need
+//     to bump the resourceVersion (and trigger every watcher) for nothing. A
+//     stale cache could already show what mutate wants while the live object
+//     doesn't. That's fine in a handler: once the cache catches up, the change
+//     is a new event and the handler runs again.
+//
+//  4. Errors are retried according to errclass.DefaultPolicy, so throttling and
+//     timeouts are retried too, not only conflicts, with errclass.DefaultBackoff
+//     and as long as the apiserver asks in Retry-After.
+func UpdateWithRetry[T generic.RuntimeMetaObject, TList runtime.Object](
+	client generic.ClientInterface[T, TList],
+	cache generic.CacheInterface[T],
+	namespace, name string,
+	mutate func(T) error,
+) (UpdateResult[T], error) {
+	var result UpdateResult[T]
+	live := false
+
+	err := errclass.DefaultPolicy.Retry(errclass.DefaultBackoff, func() error {
+		current, err := getForUpdate(client, cache, namespace, name, live)
+		if err != nil {
+			return err
+		}
+
+		result.Attempts++
+		modified := current.DeepCopyObject().(T)
+		if err := mutate(modified); err != nil {
+			return err
+		}
+
+		if equality.Semantic.DeepEqual(current, modified) {
+			result.Object = current
+			return nil
+		}
+
+		updated, err := client.Update(modified)
+		if err != nil {
+			if errclass.Classify(err) == errclass.Conflict {
+				// The version we had was stale, so stop trusting the cache
+				live = true
+			}
+			return err
+		}
+
+		result.Object = updated
+		result.Updated = true
+		return nil
+	})
+	return result, err
+}
+
+// getForUpdate returns the object to mutate
+func getForUpdate[T generic.RuntimeMetaObject, TList runtime.Object](
+	client generic.ClientInterface[T, TList],
+	cache generic.CacheInterface[T],
+	namespace, name string,
+	live bool,
+) (T, error) {
+	if !live && cache != nil {
+		obj, err := cache.Get(namespace, name)
+		if err == nil {
+			// Never modify objects coming from the cache
+			return obj.DeepCopyObject().(T), nil
+		}
+		// The cache can lag behind, eg: right after a Create. Ask k8s
+		// before giving up.
+		if errclass.Classify(err) != errclass.NotFound {
+			return obj, err
+		}
+	}
+	return client.Get(namespace, name, metav1.GetOptions{})
+}
@@ -2,13 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
-	"sync"
+	"os/signal"
 	"time"
 
+	"foo/pkg/health"
+	"foo/pkg/readiness"
+	"foo/pkg/steps"
+
+	"github.com/rancher/lasso/pkg/cache"
 	"github.com/rancher/lasso/pkg/controller"
+	"github.com/rancher/wrangler/v3/pkg/apply"
 	wapiextensions "github.com/rancher/wrangler/v3/pkg/generated/controllers/apiextensions.k8s.io"
 	wapiextensionsv1 "github.com/rancher/wrangler/v3/pkg/generated/controllers/apiextensions.k8s.io/v1"
 	wapps "github.com/rancher/wrangler/v3/pkg/generated/controllers/apps"
@@ -22,9 +31,22 @@ import (
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	rerunFrom  = flag.String("rerun-from", "", "Run this step and the ones depending on it again, even if they completed before")
+	dumpGraph  = flag.String("dump-graph", "", "Print the steps as a dot or mermaid graph and exit")
+	statusAddr = flag.String("status-addr", "", "If set (eg: localhost:8081), serve the live status of the steps at /steps, add ?format=dot or ?format=mermaid for a graph")
+	healthAddr = flag.String("health-addr", "", "If set (eg: :8082), serve /healthz and /readyz for probes and keep running until interrupted. Can be the same as -status-addr.")
 )
 
+// stepsVersion is the version of the steps recorded as complete. Bump it when
+// steps change enough that they must run again.
+const stepsVersion = "1"
+
 func main() {
+	flag.Parse()
 	if err := mainErr(); err != nil {
 		log.Fatal(err)
 	}
@@ -34,44 +56,19 @@ type Step1Context struct {
 	ConfigMap wcorev1.ConfigMapController
 	CRD       wapiextensionsv1.CustomResourceDefinitionController
 
-	Completed chan struct{}
+	Progress *steps.Progress
+	Health   *health.Checker
 }
 
 func RegisterStep1(ctx context.Context, ctrlContext Step1Context) error {
-	var once sync.Once
-	wanted := map[string]bool{
-		"foos.test.io": false,
-		"bars.test.io": false,
-	}
-	var lock sync.Mutex
+	crds := readiness.NewSet(ctrlContext.Progress.Complete, "foos.test.io", "bars.test.io")
+	ctrlContext.Progress.WaitingFor(crds.Describe)
 
-	ctrlContext.ConfigMap.OnChange(ctx, "step-1-configmap", func(key string, obj *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	ctrlContext.ConfigMap.OnChange(ctx, "step-1-configmap", health.Track(ctx, ctrlContext.Health, "step-1-configmap", func(key string, obj *corev1.ConfigMap) (*corev1.ConfigMap, error) {
 		log.Println("Received configmap step 1 key", key)
 		return obj, nil
-	})
-	ctrlContext.CRD.OnChange(ctx, "step-1-configmap", func(key string, obj *apiextensionsv1.CustomResourceDefinition) (*apiextensionsv1.CustomResourceDefinition, error) {
-		lock.Lock()
-		defer lock.Unlock()
-
-		if _, ok := wanted[key]; ok {
-			wanted[key] = true
-		}
-
-		gotAll := true
-		for _, targetGot := range wanted {
-			if !targetGot {
-				gotAll = false
-				break
-			}
-		}
-		if gotAll {
-			once.Do(func() {
-				close(ctrlContext.Completed)
-			})
-		}
-
-		return obj, nil
-	})
+	}))
+	ctrlContext.CRD.OnChange(ctx, "step-1-crds", health.Track(ctx, ctrlContext.Health, "step-1-crds", readiness.Handler(crds, readiness.CRDEstablished)))
 
 	return nil
 }
@@ -80,20 +77,82 @@ type Step2Context struct {
 	ConfigMap  wcorev1.ConfigMapController
 	Deployment wappsv1.DeploymentController
 
-	Completed chan struct{}
+	Progress *steps.Progress
+	Health   *health.Checker
 }
 
 func RegisterStep2(ctx context.Context, ctrlContext Step2Context) error {
-	var once sync.Once
+	ctrlContext.ConfigMap.OnChange(ctx, "step-2-configmap", health.Track(ctx, ctrlContext.Health, "step-2-configmap", func(key string, obj *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+		log.Println("Received configmap step 2 key", key)
+		return obj, nil
+	}))
+	nginx := readiness.NewSet(ctrlContext.Progress.Complete, readiness.Key("default", "nginx")).
+		OnError(ctrlContext.Progress.Fail)
+	ctrlContext.Progress.WaitingFor(nginx.Describe)
+
+	// Retrying with the same pods would exceed the progress deadline again,
+	// so a retry rolls out new ones like `kubectl rollout restart`. This
+	// fixes rollouts that failed for a transient reason, eg: a throttled image
+	// pull or a node that went away.
+	rolledOut := readiness.DeploymentRolledOut
+	if ctrlContext.Progress.Attempt() > 1 {
+		restarted, err := restartDeployment(ctrlContext.Deployment, "default", "nginx")
+		if err != nil {
+			return err
+		}
+		// The cache can still have the Deployment that exceeded its
+		// deadline
+		rolledOut = func(obj *appsv1.Deployment) (readiness.Status, error) {
+			if obj.Generation < restarted.Generation {
+				return readiness.Status{Reason: "waiting for the restart to be seen"}, nil
+			}
+			return readiness.DeploymentRolledOut(obj)
+		}
+	}
+	ctrlContext.Deployment.OnChange(ctx, "step-2-deployments", health.Track(ctx, ctrlContext.Health, "step-2-deployments", readiness.Handler(nginx, rolledOut)))
+
+	return nil
+}
 
+// restartDeployment rolls out new pods, the same way as `kubectl rollout
+// restart`
+func restartDeployment(deployments wappsv1.DeploymentController, namespace, name string) (*appsv1.Deployment, error) {
+	patch, err := json.Marshal(map[string]any{
+		"spec": map[string]any{
+			"template": map[string]any{
+				"metadata": map[string]any{
+					"annotations": map[string]string{
+						"kubectl.kubernetes.io/restartedAt": time.Now().Format(time.RFC3339),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Restarting deployment %s/%s", namespace, name)
+	return deployments.Patch(namespace, name, types.StrategicMergePatchType, patch)
+}
+
+// Step2Objects are the objects owned by step 2
+func Step2Objects() []runtime.Object {
+	return []runtime.Object{nginxDeployment()}
+}
+
+func nginxDeployment() *appsv1.Deployment {
 	replicas := int32(2)
-	if _, err := ctrlContext.Deployment.Create(&appsv1.Deployment{
+	// Short enough for a stuck rollout to fail step 2, and be retried, well
+	// before its timeout
+	progressDeadline := int32(120)
+	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "nginx",
 			Namespace: "default",
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: &replicas,
+			Replicas:                &replicas,
+			ProgressDeadlineSeconds: &progressDeadline,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					"app": "nginx",
@@ -120,34 +179,7 @@ func RegisterStep2(ctx context.Context, ctrlContext Step2Context) error {
 				},
 			},
 		},
-	}); err != nil {
-		return err
 	}
-
-	ctrlContext.ConfigMap.OnChange(ctx, "step-2-configmap", func(key string, obj *corev1.ConfigMap) (*corev1.ConfigMap, error) {
-		log.Println("Received configmap step 2 key", key)
-		return obj, nil
-	})
-	ctrlContext.Deployment.OnChange(ctx, "step-2-deployments", func(key string, obj *appsv1.Deployment) (*appsv1.Deployment, error) {
-		if obj == nil || obj.Namespace != "default" || obj.Name != "nginx" {
-			return obj, nil
-		}
-
-		str, ready, err := DeploymentStatus(obj)
-		if err != nil {
-			return obj, err
-		}
-		log.Println(str)
-
-		if ready {
-			once.Do(func() {
-				close(ctrlContext.Completed)
-			})
-		}
-		return obj, nil
-	})
-
-	return nil
 }
 
 type Step3Context struct {
@@ -155,24 +187,30 @@ type Step3Context struct {
 	Secret     wcorev1.SecretController
 	Deployment wappsv1.DeploymentController
 
-	Completed chan struct{}
+	Progress *steps.Progress
+	Health   *health.Checker
 }
 
 func RegisterStep3(ctx context.Context, ctrlContext Step3Context) error {
-	if _, err := ctrlContext.Secret.Create(&corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "foo",
-			Namespace: "default",
-		},
-		Data: map[string][]byte{
-			"bar": []byte("toto"),
+	secret := readiness.NewSet(ctrlContext.Progress.Complete, readiness.Key("default", "foo"))
+	ctrlContext.Progress.WaitingFor(secret.Describe)
+	ctrlContext.Secret.OnChange(ctx, "step-3-secret", health.Track(ctx, ctrlContext.Health, "step-3-secret", readiness.Handler(secret, readiness.SecretHasKey("bar"))))
+	return nil
+}
+
+// Step3Objects are the objects owned by step 3
+func Step3Objects() []runtime.Object {
+	return []runtime.Object{
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+			},
+			Data: map[string][]byte{
+				"bar": []byte("toto"),
+			},
 		},
-	}); err != nil {
-		return err
 	}
-	log.Println("Created Secret!")
-	close(ctrlContext.Completed)
-	return nil
 }
 
 // This example shows how to have initialization done in locksteps:
@@ -181,7 +219,8 @@ func RegisterStep3(ctx context.Context, ctrlContext Step3Context) error {
 // 3. Step 3 creates a secret now that foo/bars CRDs exist and "webhook" (nginx) is ready
 func mainErr() error {
 	scheme := runtime.NewScheme()
-	ctx := context.Background()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
 	corev1.AddToScheme(scheme)
 	appsv1.AddToScheme(scheme)
 	apiextensionsv1.AddToScheme(scheme)
@@ -193,7 +232,14 @@ func mainErr() error {
 		return err
 	}
 
-	opts := &controller.SharedControllerFactoryOptions{}
+	// Given the factory and graph once they exist, but lasso reports the
+	// health of the apiserver to it from the start
+	checker := health.NewChecker()
+	opts := &controller.SharedControllerFactoryOptions{
+		CacheOptions: &cache.SharedCacheFactoryOptions{
+			HealthCallback: checker.APIServerHealthy,
+		},
+	}
 	controllerFactory, err := controller.NewSharedControllerFactoryFromConfigWithOptions(restConfig, scheme, opts)
 	if err != nil {
 		return err
@@ -215,96 +261,137 @@ func mainErr() error {
 		return err
 	}
 
+	applier, err := apply.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	graph := steps.NewGraph(controllerFactory, 1)
+	graph.Apply = applier
+	graph.Store = steps.NewConfigMapStore(coreCtrl.Core().V1().ConfigMap(), "default", "startup-steps", stepsVersion)
+	graph.RerunFrom = *rerunFrom
+	checker.SetGraph(controllerFactory, graph)
+
 	// Step 1 would be things with no dependencies like.... Settings
-	ctrlStep1 := Step1Context{
+	step1 := Step1Context{
 		ConfigMap: coreCtrl.Core().V1().ConfigMap(),
 		CRD:       apiExtensionsCtrl.Apiextensions().V1().CustomResourceDefinition(),
-		Completed: make(chan struct{}, 1),
 	}
-	ctxStep1 := controller.NewHandlerTransaction(ctx)
-	log.Println("Registering Step 1")
-	err = RegisterStep1(ctxStep1, ctrlStep1)
-	if err != nil {
-		ctxStep1.Rollback()
+	if err := graph.Add(steps.Step{
+		Name: "step-1",
+		// Nothing works without the CRDs
+		Timeout: 10 * time.Minute,
+		// The configmap handler must run even when step 1 is already
+		// complete
+		Reverify: true,
+		Context:  step1,
+		Handlers: []string{"step-1-configmap", "step-1-crds"},
+		Register: func(ctx context.Context, progress *steps.Progress) error {
+			step1 := step1
+			step1.Progress = progress
+			step1.Health = checker
+			return RegisterStep1(ctx, step1)
+		},
+	}); err != nil {
 		return err
 	}
-	log.Println("Starting controller factory for step 1")
-	ctxStep1.Commit()
-	controllerFactory.Start(ctx, 1)
-
-	log.Println("Waiting for step 1 to be completed")
-	<-ctrlStep1.Completed
 
 	// Step 2 has access to things initialized in step 1.... Like.. I don't know.. Secrets?
-	ctrlStep2 := Step2Context{
+	step2 := Step2Context{
 		ConfigMap:  coreCtrl.Core().V1().ConfigMap(),
 		Deployment: appsCtrl.Apps().V1().Deployment(),
-		Completed:  make(chan struct{}, 1),
 	}
-	ctxStep2 := controller.NewHandlerTransaction(ctx)
-	log.Println("Registering Step 2")
-	err = RegisterStep2(ctxStep2, ctrlStep2)
-	if err != nil {
-		ctxStep2.Rollback()
+	if err := graph.Add(steps.Step{
+		Name:      "step-2",
+		DependsOn: []string{"step-1"},
+		Timeout:   5 * time.Minute,
+		OnFailure: steps.Retry,
+		Retries:   2,
+		// Unlike step 1's configmap handler, which keeps logging, step 2's
+		// handlers are only there until nginx is ready
+		StopOnComplete: true,
+		Objects:        Step2Objects,
+		Context:        step2,
+		Handlers:       []string{"step-2-configmap", "step-2-deployments"},
+		Register: func(ctx context.Context, progress *steps.Progress) error {
+			step2 := step2
+			step2.Progress = progress
+			step2.Health = checker
+			return RegisterStep2(ctx, step2)
+		},
+	}); err != nil {
 		return err
 	}
-	log.Println("Starting controller factory for step 2")
-	ctxStep2.Commit()
-	controllerFactory.Start(ctx, 1)
-	<-ctrlStep2.Completed
 
-	ctrlStep3 := Step3Context{
+	// Step 3 needs both the CRDs of step 1 and the "webhook" of step 2
+	step3 := Step3Context{
 		ConfigMap:  coreCtrl.Core().V1().ConfigMap(),
 		Secret:     coreCtrl.Core().V1().Secret(),
 		Deployment: appsCtrl.Apps().V1().Deployment(),
-		Completed:  make(chan struct{}, 1),
 	}
-	ctxStep3 := controller.NewHandlerTransaction(ctx)
-	log.Println("Registering Step 3")
-	err = RegisterStep3(ctxStep3, ctrlStep3)
-	if err != nil {
-		ctxStep3.Rollback()
+	if err := graph.Add(steps.Step{
+		Name:      "step-3",
+		DependsOn: []string{"step-1", "step-2"},
+		// The secret is nice to have, we can run without it
+		Timeout:        time.Minute,
+		OnFailure:      steps.Continue,
+		StopOnComplete: true,
+		Objects:        Step3Objects,
+		Context:        step3,
+		Handlers:       []string{"step-3-secret"},
+		Register: func(ctx context.Context, progress *steps.Progress) error {
+			step3 := step3
+			step3.Progress = progress
+			step3.Health = checker
+			return RegisterStep3(ctx, step3)
+		},
+	}); err != nil {
 		return err
 	}
-	log.Println("Starting controller factory for step 3")
-	ctxStep3.Commit()
-	controllerFactory.Start(ctx, 1)
-	<-ctrlStep3.Completed
 
-	time.Sleep(10 * time.Second)
-
-	return nil
-}
+	switch *dumpGraph {
+	case "":
+	case "dot":
+		return graph.WriteDOT(os.Stdout)
+	case "mermaid":
+		return graph.WriteMermaid(os.Stdout)
+	default:
+		return fmt.Errorf("unknown graph format %q, expected dot or mermaid", *dumpGraph)
+	}
 
-// Taken from kubectl codebase
-func DeploymentStatus(obj *appsv1.Deployment) (string, bool, error) {
-	if obj.Generation <= obj.Status.ObservedGeneration {
-		cond := GetDeploymentCondition(obj.Status, appsv1.DeploymentProgressing)
-		if cond != nil && cond.Reason == timedOutReason {
-			return "", false, fmt.Errorf("deployment %q exceeded its progress deadline", obj.Name)
-		}
-		if obj.Spec.Replicas != nil && obj.Status.UpdatedReplicas < *obj.Spec.Replicas {
-			return fmt.Sprintf("Waiting for deployment %q rollout to finish: %d out of %d new replicas have been updated...\n", obj.Name, obj.Status.UpdatedReplicas, *obj.Spec.Replicas), false, nil
+	// One server per address, the status and health endpoints can share one
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
 		}
-		if obj.Status.Replicas > obj.Status.UpdatedReplicas {
-			return fmt.Sprintf("Waiting for deployment %q rollout to finish: %d old replicas are pending termination...\n", obj.Name, obj.Status.Replicas-obj.Status.UpdatedReplicas), false, nil
-		}
-		if obj.Status.AvailableReplicas < obj.Status.UpdatedReplicas {
-			return fmt.Sprintf("Waiting for deployment %q rollout to finish: %d of %d updated replicas are available...\n", obj.Name, obj.Status.AvailableReplicas, obj.Status.UpdatedReplicas), false, nil
-		}
-		return fmt.Sprintf("deployment %q successfully rolled out\n", obj.Name), true, nil
+		return muxes[addr]
+	}
+	if *statusAddr != "" {
+		mux(*statusAddr).Handle("/steps", graph)
+		log.Printf("Serving step status at http://%s/steps", *statusAddr)
+	}
+	if *healthAddr != "" {
+		checker.Register(mux(*healthAddr))
+		log.Printf("Serving probes at http://%s/healthz and http://%s/readyz", *healthAddr, *healthAddr)
+	}
+	for addr, mux := range muxes {
+		go func() {
+			log.Println(http.ListenAndServe(addr, mux))
+		}()
 	}
-	return fmt.Sprintf("Waiting for deployment spec update to be observed...\n"), false, nil
-}
 
-var timedOutReason = "ProgressDeadlineExceeded"
+	if err := graph.Run(ctx); err != nil {
+		return err
+	}
 
-func GetDeploymentCondition(status appsv1.DeploymentStatus, condType appsv1.DeploymentConditionType) *appsv1.DeploymentCondition {
-	for i := range status.Conditions {
-		c := status.Conditions[i]
-		if c.Type == condType {
-			return &c
-		}
+	if *healthAddr != "" {
+		// Probes are only useful while the controllers run
+		<-ctx.Done()
+		return nil
 	}
+
+	time.Sleep(10 * time.Second)
+
 	return nil
 }
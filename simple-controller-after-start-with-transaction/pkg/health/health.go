@@ -0,0 +1,237 @@
+// Package health serves /healthz and /readyz for a controller started with a
+// step graph, so that Deployments can use liveness and readiness probes.
+//
+// /healthz fails when the controller can't do anything: the factory isn't
+// started, a cache isn't synced or the apiserver is unreachable. /readyz
+// also fails until every startup step is complete and while a handler keeps
+// failing.
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"foo/pkg/steps"
+
+	"github.com/rancher/lasso/pkg/controller"
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// DefaultFailingAfter is the default of Checker.FailingAfter
+	DefaultFailingAfter = 5 * time.Minute
+	// DefaultSyncTimeout is the default of Checker.SyncTimeout
+	DefaultSyncTimeout = time.Second
+)
+
+// Checker checks the health and readiness of a controller
+type Checker struct {
+	// FailingAfter is how long a handler must keep failing for the same
+	// key to be considered permanently failing. lasso retries it with a
+	// backoff until then.
+	FailingAfter time.Duration
+	// SyncTimeout bounds how long a check waits for caches to sync
+	SyncTimeout time.Duration
+
+	factory controller.SharedControllerFactory
+	graph   *steps.Graph
+
+	lock sync.Mutex
+	// apiServerHealthy is nil until lasso first reports it
+	apiServerHealthy *bool
+	// failing is when each handler started failing, by key
+	failing map[string]map[string]time.Time
+}
+
+// NewChecker returns a Checker, which must be given the factory and graph to
+// check with SetGraph. It's created before them so that it can be in the
+// HealthCallback of the factory.
+func NewChecker() *Checker {
+	return &Checker{
+		FailingAfter: DefaultFailingAfter,
+		SyncTimeout:  DefaultSyncTimeout,
+		failing:      map[string]map[string]time.Time{},
+	}
+}
+
+// SetGraph sets the controllers of factory, started by the steps of graph, as
+// what c checks. It must be called before Register.
+func (c *Checker) SetGraph(factory controller.SharedControllerFactory, graph *steps.Graph) {
+	c.factory = factory
+	c.graph = graph
+}
+
+// APIServerHealthy records whether the apiserver is reachable. It's meant to
+// be the HealthCallback of the cache options of the factory, which lasso calls
+// when the factory starts and when watches fail.
+func (c *Checker) APIServerHealthy(healthy bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.apiServerHealthy = &healthy
+}
+
+// Track wraps handler to record its failures in c. The failures of a key are
+// forgotten once the handler succeeds for it, and all its failures once ctx is
+// done, ie: once the handler is removed.
+func Track[T runtime.Object](ctx context.Context, c *Checker, name string, handler generic.ObjectHandler[T]) generic.ObjectHandler[T] {
+	go func() {
+		<-ctx.Done()
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.failing, name)
+	}()
+
+	return func(key string, obj T) (T, error) {
+		obj, err := handler(key, obj)
+		c.record(name, key, err)
+		return obj, err
+	}
+}
+
+func (c *Checker) record(name, key string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err == nil {
+		delete(c.failing[name], key)
+		return
+	}
+	if c.failing[name] == nil {
+		c.failing[name] = map[string]time.Time{}
+	}
+	if _, ok := c.failing[name][key]; !ok {
+		c.failing[name][key] = time.Now()
+	}
+}
+
+// check is the result of one check, err is nil if it passed
+type check struct {
+	name string
+	err  error
+}
+
+// healthz returns the checks of /healthz
+func (c *Checker) healthz(ctx context.Context) []check {
+	return []check{
+		{name: "factory", err: c.checkFactory()},
+		{name: "caches", err: c.checkCaches(ctx)},
+		{name: "apiserver", err: c.checkAPIServer()},
+	}
+}
+
+// readyz returns the checks of /readyz, which include those of /healthz
+func (c *Checker) readyz(ctx context.Context) []check {
+	return append(c.healthz(ctx),
+		check{name: "steps", err: c.checkSteps()},
+		check{name: "handlers", err: c.checkHandlers()},
+	)
+}
+
+func (c *Checker) checkFactory() error {
+	if !c.graph.FactoryStarted() {
+		return fmt.Errorf("not started")
+	}
+	return nil
+}
+
+func (c *Checker) checkCaches(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.SyncTimeout)
+	defer cancel()
+
+	var notSynced []string
+	for gvk, synced := range c.factory.SharedCacheFactory().WaitForCacheSync(ctx) {
+		if !synced {
+			notSynced = append(notSynced, gvk.Kind)
+		}
+	}
+	if len(notSynced) > 0 {
+		sort.Strings(notSynced)
+		return fmt.Errorf("not synced: %s", strings.Join(notSynced, ", "))
+	}
+	return nil
+}
+
+func (c *Checker) checkAPIServer() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Not reported yet means the factory isn't started, which is already
+	// checked
+	if c.apiServerHealthy != nil && !*c.apiServerHealthy {
+		return fmt.Errorf("unreachable")
+	}
+	return nil
+}
+
+func (c *Checker) checkSteps() error {
+	var notDone []string
+	for _, status := range c.graph.Status() {
+		if status.State != steps.Complete && status.State != steps.Degraded {
+			notDone = append(notDone, fmt.Sprintf("%s is %s", status.Name, status.State))
+		}
+	}
+	if len(notDone) > 0 {
+		return fmt.Errorf("%s", strings.Join(notDone, ", "))
+	}
+	return nil
+}
+
+func (c *Checker) checkHandlers() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var failing []string
+	for name, keys := range c.failing {
+		for key, since := range keys {
+			if time.Since(since) >= c.FailingAfter {
+				failing = append(failing, fmt.Sprintf("%s failing for %s since %s", name, key, since.Format(time.RFC3339)))
+			}
+		}
+	}
+	if len(failing) > 0 {
+		sort.Strings(failing)
+		return fmt.Errorf("%s", strings.Join(failing, ", "))
+	}
+	return nil
+}
+
+// Register adds /healthz and /readyz to mux
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, req *http.Request) {
+		writeChecks(rw, "healthz", c.healthz(req.Context()))
+	})
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, req *http.Request) {
+		writeChecks(rw, "readyz", c.readyz(req.Context()))
+	})
+}
+
+// writeChecks writes the checks the same way as the apiserver's
+// ?verbose output, with a 503 if one of them failed
+func writeChecks(rw http.ResponseWriter, endpoint string, checks []check) {
+	var b strings.Builder
+	failed := false
+	for _, check := range checks {
+		if check.err != nil {
+			failed = true
+			fmt.Fprintf(&b, "[-]%s failed: %v\n", check.name, check.err)
+		} else {
+			fmt.Fprintf(&b, "[+]%s ok\n", check.name)
+		}
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	if failed {
+		fmt.Fprintf(&b, "%s check failed\n", endpoint)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		fmt.Fprintf(&b, "%s check passed\n", endpoint)
+	}
+	io.WriteString(rw, b.String())
+}
@@ -0,0 +1,142 @@
+package readiness
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// CRDEstablished is ready once the CRD can be used, ie: its names are
+// accepted and the apiserver serves it
+func CRDEstablished(crd *apiextensionsv1.CustomResourceDefinition) (Status, error) {
+	for _, cond := range crd.Status.Conditions {
+		if cond.Type == apiextensionsv1.NamesAccepted && cond.Status == apiextensionsv1.ConditionFalse {
+			return Status{}, fmt.Errorf("CRD %q names not accepted: %s", crd.Name, cond.Message)
+		}
+	}
+	for _, cond := range crd.Status.Conditions {
+		if cond.Type == apiextensionsv1.Established && cond.Status == apiextensionsv1.ConditionTrue {
+			return Status{Ready: true, Reason: "established"}, nil
+		}
+	}
+	return Status{Reason: "waiting to be established"}, nil
+}
+
+// timedOutReason is set on the Progressing condition of Deployments that
+// exceeded their progress deadline
+const timedOutReason = "ProgressDeadlineExceeded"
+
+// DeploymentRolledOut is ready once the rollout is complete, the same way as
+// `kubectl rollout status`
+func DeploymentRolledOut(obj *appsv1.Deployment) (Status, error) {
+	if obj.Generation > obj.Status.ObservedGeneration {
+		return Status{Reason: "waiting for deployment spec update to be observed"}, nil
+	}
+
+	for _, cond := range obj.Status.Conditions {
+		if cond.Type == appsv1.DeploymentProgressing && cond.Reason == timedOutReason {
+			return Status{}, fmt.Errorf("deployment %q exceeded its progress deadline", obj.Name)
+		}
+	}
+	if obj.Spec.Replicas != nil && obj.Status.UpdatedReplicas < *obj.Spec.Replicas {
+		return Status{Reason: fmt.Sprintf("%d out of %d new replicas have been updated", obj.Status.UpdatedReplicas, *obj.Spec.Replicas)}, nil
+	}
+	if obj.Status.Replicas > obj.Status.UpdatedReplicas {
+		return Status{Reason: fmt.Sprintf("%d old replicas are pending termination", obj.Status.Replicas-obj.Status.UpdatedReplicas)}, nil
+	}
+	if obj.Status.AvailableReplicas < obj.Status.UpdatedReplicas {
+		return Status{Reason: fmt.Sprintf("%d of %d updated replicas are available", obj.Status.AvailableReplicas, obj.Status.UpdatedReplicas)}, nil
+	}
+	return Status{Ready: true, Reason: "successfully rolled out"}, nil
+}
+
+// StatefulSetRolledOut is ready once the rollout is complete, the same way as
+// `kubectl rollout status`. Only the RollingUpdate strategy is supported.
+func StatefulSetRolledOut(obj *appsv1.StatefulSet) (Status, error) {
+	if obj.Spec.UpdateStrategy.Type != appsv1.RollingUpdateStatefulSetStrategyType {
+		return Status{}, fmt.Errorf("statefulset %q: rollout status is only available for %s strategy type", obj.Name, appsv1.RollingUpdateStatefulSetStrategyType)
+	}
+	if obj.Status.ObservedGeneration == 0 || obj.Generation > obj.Status.ObservedGeneration {
+		return Status{Reason: "waiting for statefulset spec update to be observed"}, nil
+	}
+	if obj.Spec.Replicas != nil && obj.Status.ReadyReplicas < *obj.Spec.Replicas {
+		return Status{Reason: fmt.Sprintf("%d pods are not ready yet", *obj.Spec.Replicas-obj.Status.ReadyReplicas)}, nil
+	}
+	if rollingUpdate := obj.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.Partition != nil && obj.Spec.Replicas != nil {
+		if obj.Status.UpdatedReplicas < *obj.Spec.Replicas-*rollingUpdate.Partition {
+			return Status{Reason: fmt.Sprintf("partitioned rollout: %d out of %d new pods have been updated", obj.Status.UpdatedReplicas, *obj.Spec.Replicas-*rollingUpdate.Partition)}, nil
+		}
+		return Status{Ready: true, Reason: "partitioned rollout complete"}, nil
+	}
+	if obj.Status.UpdateRevision != obj.Status.CurrentRevision {
+		return Status{Reason: fmt.Sprintf("%d pods at revision %s", obj.Status.UpdatedReplicas, obj.Status.UpdateRevision)}, nil
+	}
+	return Status{Ready: true, Reason: "successfully rolled out"}, nil
+}
+
+// DaemonSetRolledOut is ready once the rollout is complete, the same way as
+// `kubectl rollout status`. Only the RollingUpdate strategy is supported.
+func DaemonSetRolledOut(obj *appsv1.DaemonSet) (Status, error) {
+	if obj.Spec.UpdateStrategy.Type != appsv1.RollingUpdateDaemonSetStrategyType {
+		return Status{}, fmt.Errorf("daemonset %q: rollout status is only available for %s strategy type", obj.Name, appsv1.RollingUpdateDaemonSetStrategyType)
+	}
+	if obj.Generation > obj.Status.ObservedGeneration {
+		return Status{Reason: "waiting for daemonset spec update to be observed"}, nil
+	}
+	if obj.Status.UpdatedNumberScheduled < obj.Status.DesiredNumberScheduled {
+		return Status{Reason: fmt.Sprintf("%d out of %d new pods have been updated", obj.Status.UpdatedNumberScheduled, obj.Status.DesiredNumberScheduled)}, nil
+	}
+	if obj.Status.NumberAvailable < obj.Status.DesiredNumberScheduled {
+		return Status{Reason: fmt.Sprintf("%d of %d updated pods are available", obj.Status.NumberAvailable, obj.Status.DesiredNumberScheduled)}, nil
+	}
+	return Status{Ready: true, Reason: "successfully rolled out"}, nil
+}
+
+// APIServiceAvailable is ready once the aggregated API is available.
+//
+// It takes an unstructured object because the APIService types live in
+// k8s.io/kube-aggregator, which isn't worth the dependency for one condition.
+func APIServiceAvailable(obj *unstructured.Unstructured) (Status, error) {
+	conditions, _, err := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	if err != nil {
+		return Status{}, err
+	}
+	for _, raw := range conditions {
+		cond, ok := raw.(map[string]interface{})
+		if !ok || cond["type"] != "Available" {
+			continue
+		}
+		if cond["status"] == "True" {
+			return Status{Ready: true, Reason: "available"}, nil
+		}
+		return Status{Reason: fmt.Sprintf("not available: %v", cond["message"])}, nil
+	}
+	return Status{Reason: "waiting for the Available condition"}, nil
+}
+
+// EndpointsReady is ready once the Endpoints have at least one ready address,
+// ie: a webhook backed by the Service can be called
+func EndpointsReady(obj *corev1.Endpoints) (Status, error) {
+	notReady := 0
+	for _, subset := range obj.Subsets {
+		if len(subset.Addresses) > 0 {
+			return Status{Ready: true, Reason: fmt.Sprintf("%d ready addresses", len(subset.Addresses))}, nil
+		}
+		notReady += len(subset.NotReadyAddresses)
+	}
+	return Status{Reason: fmt.Sprintf("no ready address, %d not ready", notReady)}, nil
+}
+
+// SecretHasKey is ready once the Secret has a non-empty value for key, eg: a
+// certificate generated by another controller
+func SecretHasKey(key string) Condition[*corev1.Secret] {
+	return func(obj *corev1.Secret) (Status, error) {
+		if len(obj.Data[key]) == 0 {
+			return Status{Reason: fmt.Sprintf("waiting for key %q", key)}, nil
+		}
+		return Status{Ready: true, Reason: fmt.Sprintf("has key %q", key)}, nil
+	}
+}
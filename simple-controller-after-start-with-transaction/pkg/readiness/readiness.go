@@ -0,0 +1,186 @@
+// Package readiness has predicates telling whether objects are ready (CRD
+// established, Deployment rolled out, ...) and a way to plug them in lasso
+// handlers to know when a whole set of objects is ready.
+package readiness
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/rancher/wrangler/v3/pkg/generic"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Status is the readiness of one object
+type Status struct {
+	Ready bool
+	// Reason says what we're still waiting for, or why it's ready
+	Reason string
+}
+
+// Condition computes the readiness of an object. An error means the object
+// will never be ready without someone stepping in, eg: a Deployment that
+// exceeded its progress deadline.
+type Condition[T runtime.Object] func(obj T) (Status, error)
+
+// notFound is the reason of objects not seen yet, or deleted
+const notFound = "not found"
+
+// Key returns the key wrangler handlers receive for an object
+func Key(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// Set tracks the readiness of a fixed set of objects, by key, and calls done
+// the first time they're all ready.
+//
+// Once done is called, the set stays done: an object becoming unready again
+// doesn't undo it.
+type Set struct {
+	lock    sync.Mutex
+	pending map[string]string
+	done    func()
+	fail    func(error)
+	isDone  bool
+}
+
+// NewSet returns a Set waiting for the objects with the given keys, see Key
+func NewSet(done func(), keys ...string) *Set {
+	pending := map[string]string{}
+	for _, key := range keys {
+		pending[key] = notFound
+	}
+	return &Set{
+		pending: pending,
+		done:    done,
+	}
+}
+
+// OnError sets a func called with the errors of conditions, eg: to fail a
+// step when a Deployment exceeds its progress deadline instead of retrying
+// forever
+func (s *Set) OnError(fail func(error)) *Set {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fail = fail
+	return s
+}
+
+// Update records the readiness of the object with key. Keys not in the set
+// are ignored.
+func (s *Set) Update(key string, status Status) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.isDone {
+		return
+	}
+	reason, ok := s.pending[key]
+	if !ok {
+		return
+	}
+	if status.Ready {
+		log.Printf("%s is ready: %s", key, status.Reason)
+		delete(s.pending, key)
+	} else {
+		if reason != status.Reason {
+			log.Printf("%s is not ready: %s", key, status.Reason)
+		}
+		s.pending[key] = status.Reason
+	}
+
+	if len(s.pending) == 0 {
+		s.isDone = true
+		s.done()
+	}
+}
+
+// Waiting returns whether the object with key is tracked and not ready yet
+func (s *Set) Waiting(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.pending[key]
+	return ok && !s.isDone
+}
+
+// Done returns whether every object has been ready
+func (s *Set) Done() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.isDone
+}
+
+// Pending returns the keys of the objects that aren't ready yet, sorted, with
+// what each one is waiting for
+func (s *Set) Pending() []Pending {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pending := make([]Pending, 0, len(s.pending))
+	for key, reason := range s.pending {
+		pending = append(pending, Pending{Key: key, Reason: reason})
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Key < pending[j].Key
+	})
+	return pending
+}
+
+// Describe returns what each pending object is waiting for, in a form fit for
+// logs
+func (s *Set) Describe() []string {
+	var descriptions []string
+	for _, p := range s.Pending() {
+		descriptions = append(descriptions, p.Key+": "+p.Reason)
+	}
+	return descriptions
+}
+
+// Pending is an object that isn't ready yet
+type Pending struct {
+	Key    string
+	Reason string
+}
+
+// Handler returns an OnChange handler that updates set with the readiness of
+// the objects it's waiting for, other objects are skipped. An error of cond is
+// returned so that it shows up in the logs and the object is retried.
+func Handler[T runtime.Object](set *Set, cond Condition[T]) generic.ObjectHandler[T] {
+	return func(key string, obj T) (T, error) {
+		if !set.Waiting(key) {
+			return obj, nil
+		}
+		if isNil(obj) {
+			set.Update(key, Status{Reason: notFound})
+			return obj, nil
+		}
+		status, err := cond(obj)
+		if err != nil {
+			set.reportError(err)
+			return obj, err
+		}
+		set.Update(key, status)
+		return obj, nil
+	}
+}
+
+func (s *Set) reportError(err error) {
+	s.lock.Lock()
+	fail := s.fail
+	s.lock.Unlock()
+	if fail != nil {
+		fail(err)
+	}
+}
+
+// isNil returns whether obj is nil, which is how wrangler handlers are told
+// the object was deleted
+func isNil(obj runtime.Object) bool {
+	v := reflect.ValueOf(obj)
+	return !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil())
+}
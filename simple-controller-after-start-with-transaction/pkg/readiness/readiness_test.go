@@ -0,0 +1,309 @@
+package readiness
+
+import (
+	"errors"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestConditions(t *testing.T) {
+	replicas := int32(2)
+	partition := int32(1)
+	tests := []struct {
+		name      string
+		condition func() (Status, error)
+		wantReady bool
+		wantErr   bool
+	}{
+		{
+			name: "crd established",
+			condition: func() (Status, error) {
+				return CRDEstablished(crd(apiextensionsv1.CustomResourceDefinitionCondition{Type: apiextensionsv1.Established, Status: apiextensionsv1.ConditionTrue}))
+			},
+			wantReady: true,
+		},
+		{
+			name:      "crd not established yet",
+			condition: func() (Status, error) { return CRDEstablished(crd()) },
+		},
+		{
+			name: "crd names not accepted",
+			condition: func() (Status, error) {
+				return CRDEstablished(crd(apiextensionsv1.CustomResourceDefinitionCondition{Type: apiextensionsv1.NamesAccepted, Status: apiextensionsv1.ConditionFalse}))
+			},
+			wantErr: true,
+		},
+		{
+			name: "deployment rolled out",
+			condition: func() (Status, error) {
+				return DeploymentRolledOut(&appsv1.Deployment{
+					Spec:   appsv1.DeploymentSpec{Replicas: &replicas},
+					Status: appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2},
+				})
+			},
+			wantReady: true,
+		},
+		{
+			name: "deployment spec not observed",
+			condition: func() (Status, error) {
+				return DeploymentRolledOut(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Generation: 2}, Status: appsv1.DeploymentStatus{ObservedGeneration: 1}})
+			},
+		},
+		{
+			name: "deployment with old replicas",
+			condition: func() (Status, error) {
+				return DeploymentRolledOut(&appsv1.Deployment{
+					Spec:   appsv1.DeploymentSpec{Replicas: &replicas},
+					Status: appsv1.DeploymentStatus{Replicas: 3, UpdatedReplicas: 2, AvailableReplicas: 2},
+				})
+			},
+		},
+		{
+			name: "deployment exceeded its progress deadline",
+			condition: func() (Status, error) {
+				return DeploymentRolledOut(&appsv1.Deployment{Status: appsv1.DeploymentStatus{Conditions: []appsv1.DeploymentCondition{
+					{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: timedOutReason},
+				}}})
+			},
+			wantErr: true,
+		},
+		{
+			name: "statefulset rolled out",
+			condition: func() (Status, error) {
+				return StatefulSetRolledOut(statefulSet(&replicas, nil, appsv1.StatefulSetStatus{ObservedGeneration: 1, ReadyReplicas: 2, UpdateRevision: "a", CurrentRevision: "a"}))
+			},
+			wantReady: true,
+		},
+		{
+			name: "statefulset at an older revision",
+			condition: func() (Status, error) {
+				return StatefulSetRolledOut(statefulSet(&replicas, nil, appsv1.StatefulSetStatus{ObservedGeneration: 1, ReadyReplicas: 2, UpdateRevision: "b", CurrentRevision: "a"}))
+			},
+		},
+		{
+			name: "statefulset partitioned rollout complete",
+			condition: func() (Status, error) {
+				return StatefulSetRolledOut(statefulSet(&replicas, &partition, appsv1.StatefulSetStatus{ObservedGeneration: 1, ReadyReplicas: 2, UpdatedReplicas: 1, UpdateRevision: "b", CurrentRevision: "a"}))
+			},
+			wantReady: true,
+		},
+		{
+			name: "statefulset with OnDelete strategy",
+			condition: func() (Status, error) {
+				return StatefulSetRolledOut(&appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}}})
+			},
+			wantErr: true,
+		},
+		{
+			name: "daemonset rolled out",
+			condition: func() (Status, error) {
+				return DaemonSetRolledOut(daemonSet(appsv1.DaemonSetStatus{DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 3}))
+			},
+			wantReady: true,
+		},
+		{
+			name: "daemonset with unavailable pods",
+			condition: func() (Status, error) {
+				return DaemonSetRolledOut(daemonSet(appsv1.DaemonSetStatus{DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 2}))
+			},
+		},
+		{
+			name: "daemonset with OnDelete strategy",
+			condition: func() (Status, error) {
+				return DaemonSetRolledOut(&appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType}}})
+			},
+			wantErr: true,
+		},
+		{
+			name:      "apiservice available",
+			condition: func() (Status, error) { return APIServiceAvailable(apiService("True")) },
+			wantReady: true,
+		},
+		{
+			name:      "apiservice not available",
+			condition: func() (Status, error) { return APIServiceAvailable(apiService("False")) },
+		},
+		{
+			name: "apiservice without conditions",
+			condition: func() (Status, error) {
+				return APIServiceAvailable(&unstructured.Unstructured{Object: map[string]interface{}{}})
+			},
+		},
+		{
+			name: "apiservice with malformed conditions",
+			condition: func() (Status, error) {
+				return APIServiceAvailable(&unstructured.Unstructured{Object: map[string]interface{}{"status": map[string]interface{}{"conditions": "Available"}}})
+			},
+			wantErr: true,
+		},
+		{
+			name: "endpoints with a ready address",
+			condition: func() (Status, error) {
+				return EndpointsReady(&corev1.Endpoints{Subsets: []corev1.EndpointSubset{
+					{NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}}},
+					{Addresses: []corev1.EndpointAddress{{IP: "10.0.0.2"}}},
+				}})
+			},
+			wantReady: true,
+		},
+		{
+			name: "endpoints without ready address",
+			condition: func() (Status, error) {
+				return EndpointsReady(&corev1.Endpoints{Subsets: []corev1.EndpointSubset{
+					{NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}}},
+				}})
+			},
+		},
+		{
+			name: "secret has key",
+			condition: func() (Status, error) {
+				return SecretHasKey("tls.crt")(&corev1.Secret{Data: map[string][]byte{"tls.crt": []byte("cert")}})
+			},
+			wantReady: true,
+		},
+		{
+			name: "secret with empty key",
+			condition: func() (Status, error) {
+				return SecretHasKey("tls.crt")(&corev1.Secret{Data: map[string][]byte{"tls.crt": {}}})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := tt.condition()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if status.Ready != tt.wantReady {
+				t.Errorf("ready = %t (%s), want %t", status.Ready, status.Reason, tt.wantReady)
+			}
+			if err == nil && status.Reason == "" {
+				t.Errorf("no reason")
+			}
+		})
+	}
+}
+
+func crd(conditions ...apiextensionsv1.CustomResourceDefinitionCondition) *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "foos.test.io"},
+		Status:     apiextensionsv1.CustomResourceDefinitionStatus{Conditions: conditions},
+	}
+}
+
+func statefulSet(replicas, partition *int32, status appsv1.StatefulSetStatus) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Generation: 1},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: replicas,
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: partition},
+			},
+		},
+		Status: status,
+	}
+}
+
+func daemonSet(status appsv1.DaemonSetStatus) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		Spec:   appsv1.DaemonSetSpec{UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.RollingUpdateDaemonSetStrategyType}},
+		Status: status,
+	}
+}
+
+func apiService(available string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Available", "status": available, "message": "failing or missing response"},
+			},
+		},
+	}}
+}
+
+func TestHandler(t *testing.T) {
+	done := 0
+	var failed []error
+	set := NewSet(func() { done++ }, Key("default", "a"), Key("default", "b")).
+		OnError(func(err error) { failed = append(failed, err) })
+	handler := Handler(set, SecretHasKey("key"))
+
+	withKey := &corev1.Secret{Data: map[string][]byte{"key": []byte("value")}}
+	withoutKey := &corev1.Secret{}
+
+	call := func(key string, obj *corev1.Secret) error {
+		t.Helper()
+		_, err := handler(key, obj)
+		return err
+	}
+
+	// Objects not in the set are skipped
+	if err := call(Key("default", "other"), withKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(Key("default", "a"), withoutKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(Key("default", "b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []Pending{{Key: "default/a", Reason: `waiting for key "key"`}, {Key: "default/b", Reason: notFound}}
+	if got := set.Pending(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("pending = %v, want %v", got, want)
+	}
+
+	if err := call(Key("default", "a"), withKey); err != nil {
+		t.Fatal(err)
+	}
+	if set.Waiting(Key("default", "a")) || !set.Waiting(Key("default", "b")) {
+		t.Errorf("waiting for a=%t b=%t, want only b", set.Waiting(Key("default", "a")), set.Waiting(Key("default", "b")))
+	}
+	if done != 0 {
+		t.Fatalf("done called before every object is ready")
+	}
+
+	if err := call(Key("default", "b"), withKey); err != nil {
+		t.Fatal(err)
+	}
+	if done != 1 || !set.Done() {
+		t.Fatalf("done called %d times, want 1", done)
+	}
+
+	// The set stays done
+	if err := call(Key("default", "b"), withoutKey); err != nil {
+		t.Fatal(err)
+	}
+	if done != 1 || !set.Done() || len(set.Pending()) != 0 {
+		t.Errorf("set no longer done after an object became unready")
+	}
+	if len(failed) != 0 {
+		t.Errorf("OnError called with %v", failed)
+	}
+}
+
+func TestHandlerError(t *testing.T) {
+	var failed []error
+	set := NewSet(func() { t.Error("done called") }, Key("default", "nginx")).
+		OnError(func(err error) { failed = append(failed, err) })
+	boom := errors.New("boom")
+	handler := Handler(set, func(*corev1.Secret) (Status, error) {
+		return Status{}, boom
+	})
+
+	// The error is returned so that the object is retried
+	if _, err := handler(Key("default", "nginx"), &corev1.Secret{}); !errors.Is(err, boom) {
+		t.Errorf("error = %v, want %v", err, boom)
+	}
+	if len(failed) != 1 || !errors.Is(failed[0], boom) {
+		t.Errorf("OnError called with %v, want [%v]", failed, boom)
+	}
+	if !set.Waiting(Key("default", "nginx")) {
+		t.Errorf("object no longer waited for after an error")
+	}
+}
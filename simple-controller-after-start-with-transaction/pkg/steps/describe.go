@@ -0,0 +1,193 @@
+package steps
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// StepStatus describes a step and where it's at
+type StepStatus struct {
+	Name      string   `json:"name"`
+	State     State    `json:"state"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+	Handlers  []string `json:"handlers,omitempty"`
+	GVKs      []string `json:"gvks,omitempty"`
+	Attempts  int      `json:"attempts,omitempty"`
+	// RunningFor is only set for running steps
+	RunningFor string `json:"runningFor,omitempty"`
+	// Waiting is what a running step is still waiting for
+	Waiting []string `json:"waiting,omitempty"`
+	// Error is the last failure of the step
+	Error string `json:"error,omitempty"`
+}
+
+// Status returns every step in the order they were added. It can be called
+// at any time, before Run all steps are pending.
+func (g *Graph) Status() []StepStatus {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	statuses := make([]StepStatus, 0, len(g.order))
+	for _, name := range g.order {
+		step := g.steps[name]
+		status := StepStatus{
+			Name:      name,
+			State:     Pending,
+			DependsOn: step.DependsOn,
+			Handlers:  step.Handlers,
+			GVKs:      contextGVKs(step.Context),
+		}
+		if st, ok := g.states[name]; ok {
+			status.State = st.state
+			status.Attempts = st.attempts
+			if st.err != nil {
+				status.Error = st.err.Error()
+			}
+			if st.state == Running {
+				status.RunningFor = time.Since(st.current.started).Round(time.Second).String()
+				status.Waiting = st.current.progress.Waiting()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// gvkGetter is implemented by wrangler controllers
+type gvkGetter interface {
+	GroupVersionKind() schema.GroupVersionKind
+}
+
+// contextGVKs returns the GVKs of the controllers in the fields of a step
+// context, sorted, eg: "apps/v1/Deployment"
+func contextGVKs(stepContext any) []string {
+	v := reflect.ValueOf(stepContext)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	var gvks []string
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !field.CanInterface() || (field.Kind() == reflect.Interface && field.IsNil()) {
+			continue
+		}
+		getter, ok := field.Interface().(gvkGetter)
+		if !ok {
+			continue
+		}
+		// Not String(), its commas are confusing in a list
+		gvk := getter.GroupVersionKind().GroupVersion().String() + "/" + getter.GroupVersionKind().Kind
+		if !seen[gvk] {
+			seen[gvk] = true
+			gvks = append(gvks, gvk)
+		}
+	}
+	sort.Strings(gvks)
+	return gvks
+}
+
+// stateColors are the fill colors of steps in graphs
+var stateColors = map[State]string{
+	Pending:  "#eeeeee",
+	Running:  "#fff3b0",
+	Complete: "#b7e4c7",
+	Failed:   "#f4a6a6",
+	Degraded: "#ffd6a5",
+}
+
+// WriteDOT writes the graph in Graphviz DOT format, eg: for `dot -Tsvg`.
+// Steps are colored by state.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph steps {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, style=filled, fontname=monospace];\n")
+	for _, status := range g.Status() {
+		label := strings.Join(append([]string{fmt.Sprintf("%s (%s)", status.Name, status.State)}, describeLines(status)...), `\l`) + `\l`
+		// Not %q, which would escape the \l line breaks
+		fmt.Fprintf(&b, "  %q [label=\"%s\", fillcolor=%q];\n", status.Name, strings.ReplaceAll(label, `"`, `\"`), stateColors[status.State])
+		for _, dep := range status.DependsOn {
+			fmt.Fprintf(&b, "  %q -> %q;\n", dep, status.Name)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteMermaid writes the graph as a Mermaid flowchart, eg: to paste in a
+// markdown file. Steps are colored by state.
+func (g *Graph) WriteMermaid(w io.Writer) error {
+	statuses := g.Status()
+	ids := map[string]string{}
+	for i, status := range statuses {
+		ids[status.Name] = fmt.Sprintf("step%d", i)
+	}
+
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for _, status := range statuses {
+		lines := append([]string{fmt.Sprintf("<b>%s</b> (%s)", status.Name, status.State)}, describeLines(status)...)
+		fmt.Fprintf(&b, "  %s[\"%s\"]\n", ids[status.Name], strings.ReplaceAll(strings.Join(lines, "<br/>"), `"`, "#quot;"))
+		fmt.Fprintf(&b, "  style %s fill:%s\n", ids[status.Name], stateColors[status.State])
+		for _, dep := range status.DependsOn {
+			fmt.Fprintf(&b, "  %s --> %s\n", ids[dep], ids[status.Name])
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// describeLines are the lines shown under the name of a step in graphs
+func describeLines(status StepStatus) []string {
+	var lines []string
+	if len(status.Handlers) > 0 {
+		lines = append(lines, "handlers: "+strings.Join(status.Handlers, ", "))
+	}
+	if len(status.GVKs) > 0 {
+		lines = append(lines, "gvks: "+strings.Join(status.GVKs, ", "))
+	}
+	if len(status.Waiting) > 0 {
+		lines = append(lines, "waiting: "+strings.Join(status.Waiting, ", "))
+	}
+	if status.Error != "" {
+		lines = append(lines, "error: "+status.Error)
+	}
+	return lines
+}
+
+// ServeHTTP serves the live status of the steps, as JSON by default, or as a
+// graph with ?format=dot or ?format=mermaid
+func (g *Graph) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var err error
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "json":
+		rw.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(rw).Encode(g.Status())
+	case "dot":
+		rw.Header().Set("Content-Type", "text/vnd.graphviz")
+		err = g.WriteDOT(rw)
+	case "mermaid":
+		rw.Header().Set("Content-Type", "text/plain")
+		err = g.WriteMermaid(rw)
+	default:
+		http.Error(rw, fmt.Sprintf("unknown format %q, expected json, dot or mermaid", format), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
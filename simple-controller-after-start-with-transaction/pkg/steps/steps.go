@@ -0,0 +1,675 @@
+// Package steps runs startup steps of a controller as a graph.
+//
+// Each step registers its handlers inside a HandlerTransaction, once all the
+// steps it depends on are complete. The handlers only start if the whole
+// registration succeeded, otherwise the transaction is rolled back and nothing
+// of the step runs. A step is complete when one of its handlers says so, eg:
+// once the CRDs it needs are there.
+package steps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/lasso/pkg/controller"
+	"github.com/rancher/wrangler/v3/pkg/apply"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DefaultProgressInterval is how often running steps log what they're waiting
+// for
+const DefaultProgressInterval = 30 * time.Second
+
+// DefaultRetryDelay is how long a step waits before its first retry, see
+// Step.RetryDelay
+const DefaultRetryDelay = 5 * time.Second
+
+// MaxRetryDelay caps the delay between retries of a step
+const MaxRetryDelay = 5 * time.Minute
+
+// FailurePolicy is what to do when a step fails: its registration returned an
+// error, it timed out or it called Progress.Fail
+type FailurePolicy string
+
+const (
+	// Abort makes Run return the step's error. This is the default.
+	Abort FailurePolicy = "abort"
+	// Retry registers the step again, with fresh handlers, up to
+	// Step.Retries times, after Step.RetryDelay. Run returns the error once retries are exhausted.
+	Retry FailurePolicy = "retry"
+	// Continue marks the step as degraded and carries on as if it was
+	// complete: the steps depending on it are registered anyway. For steps
+	// that are nice to have.
+	Continue FailurePolicy = "continue"
+)
+
+// State is where a step is at
+type State string
+
+const (
+	Pending  State = "pending"
+	Running  State = "running"
+	Complete State = "complete"
+	Failed   State = "failed"
+	Degraded State = "degraded"
+)
+
+// Step is a unit of startup work
+type Step struct {
+	Name string
+	// DependsOn are the names of the steps that must be complete before this
+	// one is registered
+	DependsOn []string
+	// Register registers the handlers of the step. ctx is a HandlerTransaction
+	// and must be passed to OnChange and friends. It's cancelled when the step
+	// fails, or completes with StopOnComplete, which removes the step's
+	// handlers.
+	//
+	// progress must be told once the step is complete, usually from one of
+	// its handlers.
+	Register func(ctx context.Context, progress *Progress) error
+
+	// Context is the struct holding the controllers the step uses, eg:
+	// Step1Context. It's only used to describe the step: its fields that
+	// are wrangler controllers tell which GVKs the step touches.
+	Context any
+	// Handlers are the names of the handlers Register registers, to
+	// describe the step
+	Handlers []string
+
+	// Timeout fails the step if it isn't complete in time. 0 means no
+	// timeout.
+	Timeout time.Duration
+	// OnFailure defaults to Abort
+	OnFailure FailurePolicy
+	// Retries is how many times the step is registered again with Retry
+	Retries int
+	// RetryDelay is how long to wait before the first retry, doubled for
+	// each following one up to MaxRetryDelay, so that whatever made the
+	// step fail has time to go away. Defaults to DefaultRetryDelay.
+	RetryDelay time.Duration
+	// Objects are the objects the step owns, eg: a Deployment it waits for.
+	// They're applied before Register with a set ID per step, see SetID, so
+	// a restart or a retry updates them instead of failing with
+	// AlreadyExists, and objects the step no longer returns are deleted.
+	Objects func() []runtime.Object
+
+	// Reverify registers the step even if the Store says it's complete. Its
+	// readiness conditions then confirm it's still done, which is usually
+	// quick. Needed by steps whose handlers must run for the whole life of
+	// the process. Other complete steps are skipped.
+	Reverify bool
+
+	// StopOnComplete removes the handlers of the step once it's complete,
+	// for steps whose handlers only exist to tell when the step is done.
+	//
+	// Note that lasso removes handlers asynchronously, so a handler already
+	// being called can still finish. The controllers and caches are shared
+	// and keep running.
+	StopOnComplete bool
+}
+
+// SetID returns the apply set ID of the objects of a step
+func SetID(step string) string {
+	return "startup-step-" + step
+}
+
+// Progress is how a step reports on itself. Only the first call to Complete or
+// Fail counts.
+type Progress struct {
+	attempt int
+	once    sync.Once
+	finish  func(err error)
+
+	lock    sync.Mutex
+	waiting []func() []string
+}
+
+// Complete marks the step as complete. It can be called from handlers, more
+// than once, and right away by steps that have nothing to wait for.
+func (p *Progress) Complete() {
+	p.once.Do(func() {
+		p.finish(nil)
+	})
+}
+
+// Fail fails the step, see FailurePolicy
+func (p *Progress) Fail(err error) {
+	if err == nil {
+		err = errors.New("failed")
+	}
+	p.once.Do(func() {
+		p.finish(err)
+	})
+}
+
+// Attempt returns the number of the attempt, starting at 1. Steps that are
+// retried can use it to undo what made the previous attempt fail.
+func (p *Progress) Attempt() int {
+	return p.attempt
+}
+
+// WaitingFor adds a func describing what the step is still waiting for. It's
+// called periodically to log progress, eg: with readiness.Set.Describe.
+func (p *Progress) WaitingFor(f func() []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.waiting = append(p.waiting, f)
+}
+
+// Waiting returns what the step is still waiting for
+func (p *Progress) Waiting() []string {
+	p.lock.Lock()
+	funcs := p.waiting
+	p.lock.Unlock()
+
+	var waiting []string
+	for _, f := range funcs {
+		waiting = append(waiting, f()...)
+	}
+	return waiting
+}
+
+// attempt is one registration of a step
+type attempt struct {
+	step     *Step
+	number   int
+	started  time.Time
+	progress *Progress
+	cancel   context.CancelFunc
+	timer    *time.Timer
+}
+
+// result is the outcome of an attempt, a nil err means complete
+type result struct {
+	attempt *attempt
+	err     error
+}
+
+type stepState struct {
+	state    State
+	attempts int
+	err      error
+	// current is the running attempt. Results of older attempts are
+	// ignored.
+	current *attempt
+	// retryAt is when a Pending step that failed can be registered again
+	retryAt time.Time
+}
+
+// Graph is a set of steps and their dependencies
+type Graph struct {
+	// ProgressInterval is how often running steps log what they're waiting
+	// for. 0 disables progress logs.
+	ProgressInterval time.Duration
+	// Apply applies the Objects of steps. Only needed if a step has
+	// Objects.
+	Apply apply.Apply
+	// Store persists complete steps across restarts. Optional.
+	Store Store
+	// RerunFrom is the name of a step to run again even if the Store says
+	// it's complete, along with every step depending on it
+	RerunFrom string
+
+	factory controller.SharedControllerFactory
+	workers int
+
+	steps map[string]*Step
+	// order is the order steps were added in, to register steps that
+	// become ready at the same time in a predictable order
+	order []string
+
+	// lock protects states and factoryStarted, which Status and
+	// FactoryStarted read while Run writes them
+	lock           sync.Mutex
+	states         map[string]*stepState
+	factoryStarted bool
+}
+
+// NewGraph returns an empty graph. factory is started with workers after every
+// step registration, to start the controllers of new handlers.
+func NewGraph(factory controller.SharedControllerFactory, workers int) *Graph {
+	return &Graph{
+		ProgressInterval: DefaultProgressInterval,
+		factory:          factory,
+		workers:          workers,
+		steps:            map[string]*Step{},
+	}
+}
+
+// Add adds a step. Its dependencies don't need to be added yet.
+func (g *Graph) Add(step Step) error {
+	if step.Name == "" {
+		return fmt.Errorf("step has no name")
+	}
+	if step.Register == nil {
+		return fmt.Errorf("step %s has no Register func", step.Name)
+	}
+	if _, ok := g.steps[step.Name]; ok {
+		return fmt.Errorf("step %s added twice", step.Name)
+	}
+	switch step.OnFailure {
+	case "":
+		step.OnFailure = Abort
+	case Abort, Retry, Continue:
+	default:
+		return fmt.Errorf("step %s has unknown failure policy %q", step.Name, step.OnFailure)
+	}
+	if step.RetryDelay == 0 {
+		step.RetryDelay = DefaultRetryDelay
+	}
+	g.steps[step.Name] = &step
+	g.order = append(g.order, step.Name)
+	return nil
+}
+
+// Steps returns the steps in the order they were added
+func (g *Graph) Steps() []Step {
+	steps := make([]Step, 0, len(g.order))
+	for _, name := range g.order {
+		steps = append(steps, *g.steps[name])
+	}
+	return steps
+}
+
+// Validate checks that every dependency exists, that there's no cycle and
+// that the graph is configured for its steps
+func (g *Graph) Validate() error {
+	if g.RerunFrom != "" && g.steps[g.RerunFrom] == nil {
+		return fmt.Errorf("unknown step %s to rerun from", g.RerunFrom)
+	}
+	for _, name := range g.order {
+		if g.steps[name].Objects != nil && g.Apply == nil {
+			return fmt.Errorf("step %s has objects but the graph has no Apply", name)
+		}
+		for _, dep := range g.steps[name].DependsOn {
+			if _, ok := g.steps[dep]; !ok {
+				return fmt.Errorf("step %s depends on unknown step %s", name, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %v", append(path, name))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, dep := range g.steps[name].DependsOn {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, name := range g.order {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run registers every step as soon as its dependencies are complete, and
+// returns once all steps are complete or degraded.
+//
+// Steps are registered one at a time, from this goroutine, so a step's
+// Register never runs concurrently with another's. When a step fails, its
+// handlers are removed and its FailurePolicy applies. Run returns the error of
+// the first step that can't go on. Steps that were already complete keep
+// running.
+func (g *Graph) Run(ctx context.Context) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+
+	// Each attempt sends at most one result, so this never blocks
+	size := 0
+	states := map[string]*stepState{}
+	for _, name := range g.order {
+		states[name] = &stepState{state: Pending}
+		size += g.maxAttempts(g.steps[name])
+	}
+	results := make(chan result, size)
+
+	g.lock.Lock()
+	g.states = states
+	g.lock.Unlock()
+
+	if err := g.restore(); err != nil {
+		return err
+	}
+
+	var progress <-chan time.Time
+	if g.ProgressInterval > 0 {
+		ticker := time.NewTicker(g.ProgressInterval)
+		defer ticker.Stop()
+		progress = ticker.C
+	}
+
+	for !g.finished() {
+		// The earliest retry that isn't due yet, to wake up for it
+		var nextRetry time.Time
+		for _, name := range g.order {
+			st := g.states[name]
+			if st.state != Pending || !g.ready(name) {
+				continue
+			}
+			if time.Now().Before(st.retryAt) {
+				if nextRetry.IsZero() || st.retryAt.Before(nextRetry) {
+					nextRetry = st.retryAt
+				}
+				continue
+			}
+			if err := g.start(ctx, g.steps[name], results); err != nil {
+				return err
+			}
+		}
+
+		var retry *time.Timer
+		var retryC <-chan time.Time
+		if !nextRetry.IsZero() {
+			retry = time.NewTimer(time.Until(nextRetry))
+			retryC = retry.C
+		}
+
+		var err error
+		select {
+		case r := <-results:
+			err = g.finish(r)
+		case <-retryC:
+		case <-progress:
+			g.logProgress()
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if retry != nil {
+			retry.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The factory isn't started yet if every step was already complete
+	return g.startFactory(ctx)
+}
+
+func (g *Graph) maxAttempts(step *Step) int {
+	if step.OnFailure == Retry {
+		return step.Retries + 1
+	}
+	return 1
+}
+
+// finished returns whether every step is complete or degraded
+func (g *Graph) finished() bool {
+	for _, st := range g.states {
+		if st.state != Complete && st.state != Degraded {
+			return false
+		}
+	}
+	return true
+}
+
+// ready returns whether every dependency of the step is complete or degraded
+func (g *Graph) ready(name string) bool {
+	for _, dep := range g.steps[name].DependsOn {
+		if state := g.states[dep].state; state != Complete && state != Degraded {
+			return false
+		}
+	}
+	return true
+}
+
+// start applies the objects of the step and registers a new attempt. A failed
+// apply or registration is reported like any other failure, through results.
+func (g *Graph) start(ctx context.Context, step *Step, results chan<- result) error {
+	st := g.states[step.Name]
+
+	stepCtx, cancel := context.WithCancel(ctx)
+	a := &attempt{
+		step:    step,
+		number:  st.attempts + 1,
+		started: time.Now(),
+		cancel:  cancel,
+	}
+	a.progress = &Progress{
+		attempt: a.number,
+		finish: func(err error) {
+			results <- result{attempt: a, err: err}
+		},
+	}
+	g.lock.Lock()
+	st.attempts = a.number
+	st.state = Running
+	st.current = a
+	g.lock.Unlock()
+
+	if step.Timeout > 0 {
+		a.timer = time.AfterFunc(step.Timeout, func() {
+			a.progress.Fail(fmt.Errorf("not complete after %s", step.Timeout))
+		})
+	}
+
+	if step.Objects != nil {
+		objs := step.Objects()
+		log.Printf("Applying %d objects of step %s", len(objs), step.Name)
+		if err := g.Apply.WithContext(stepCtx).WithSetID(SetID(step.Name)).WithDynamicLookup().ApplyObjects(objs...); err != nil {
+			a.progress.Fail(fmt.Errorf("applying objects: %w", err))
+			return nil
+		}
+	}
+
+	txn := controller.NewHandlerTransaction(stepCtx)
+	log.Printf("Registering step %s (attempt %d)", step.Name, a.number)
+	if err := step.Register(txn, a.progress); err != nil {
+		txn.Rollback()
+		a.progress.Fail(fmt.Errorf("registering: %w", err))
+		return nil
+	}
+	txn.Commit()
+
+	log.Printf("Starting controller factory for step %s", step.Name)
+	return g.startFactory(ctx)
+}
+
+// startFactory starts the controllers of new handlers
+func (g *Graph) startFactory(ctx context.Context) error {
+	if err := g.factory.Start(ctx, g.workers); err != nil {
+		return err
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.factoryStarted = true
+	return nil
+}
+
+// FactoryStarted returns whether Run started the controller factory, which
+// also means the caches it had then were synced
+func (g *Graph) FactoryStarted() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.factoryStarted
+}
+
+// finish handles the result of an attempt. It returns an error if Run must
+// stop.
+func (g *Graph) finish(r result) error {
+	a := r.attempt
+	st := g.states[a.step.Name]
+	if st.current != a || st.state != Running {
+		return nil
+	}
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+
+	if r.err == nil {
+		log.Printf("Step %s completed in %s", a.step.Name, time.Since(a.started).Round(time.Millisecond))
+		g.setState(st, Complete, nil)
+		if g.Store != nil {
+			// Not worth failing the startup for, the step just runs
+			// again on the next one
+			if err := g.Store.MarkComplete(a.step.Name); err != nil {
+				log.Printf("Failed to record step %s as complete: %v", a.step.Name, err)
+			}
+		}
+		if a.step.StopOnComplete {
+			log.Printf("Removing handlers of step %s", a.step.Name)
+			a.cancel()
+		}
+		return nil
+	}
+
+	log.Printf("Step %s failed (attempt %d): %v", a.step.Name, a.number, r.err)
+	// Removes the handlers of the step, so that a retry starts from scratch
+	a.cancel()
+
+	switch a.step.OnFailure {
+	case Retry:
+		if st.attempts < g.maxAttempts(a.step) {
+			delay := retryDelay(a.step, a.number)
+			log.Printf("Retrying step %s in %s", a.step.Name, delay)
+			st.retryAt = time.Now().Add(delay)
+			g.setState(st, Pending, r.err)
+			return nil
+		}
+	case Continue:
+		log.Printf("Continuing without step %s", a.step.Name)
+		g.setState(st, Degraded, r.err)
+		return nil
+	}
+	g.setState(st, Failed, r.err)
+	return fmt.Errorf("step %s: %w", a.step.Name, r.err)
+}
+
+// retryDelay returns how long to wait before retrying the step after its
+// attempt failed
+func retryDelay(step *Step, attempt int) time.Duration {
+	delay := step.RetryDelay
+	for i := 1; i < attempt && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, MaxRetryDelay)
+}
+
+// setState is the only way to change the state of a step once Run started
+func (g *Graph) setState(st *stepState, state State, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	st.state = state
+	st.err = err
+}
+
+// restore marks the steps the Store has as complete, except those to rerun
+// and those to reverify
+func (g *Graph) restore() error {
+	if g.Store == nil {
+		return nil
+	}
+
+	rerun := g.dependents(g.RerunFrom)
+	if len(rerun) > 0 {
+		log.Printf("Running steps again: %s", strings.Join(rerun, ", "))
+		if err := g.Store.Forget(rerun...); err != nil {
+			return err
+		}
+	}
+
+	completed, err := g.Store.Completed()
+	if err != nil {
+		return err
+	}
+	for _, name := range g.order {
+		if !slices.Contains(completed, name) || slices.Contains(rerun, name) {
+			continue
+		}
+		step := g.steps[name]
+		if step.Reverify {
+			log.Printf("Step %s was complete, verifying it still is", name)
+			continue
+		}
+		log.Printf("Step %s was complete, skipping it", name)
+		g.setState(g.states[name], Complete, nil)
+	}
+	return nil
+}
+
+// dependents returns the step and every step depending on it, directly or
+// not, in the order they were added
+func (g *Graph) dependents(name string) []string {
+	if name == "" {
+		return nil
+	}
+	found := map[string]bool{name: true}
+	for changed := true; changed; {
+		changed = false
+		for _, step := range g.order {
+			if found[step] {
+				continue
+			}
+			for _, dep := range g.steps[step].DependsOn {
+				if found[dep] {
+					found[step] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	var dependents []string
+	for _, step := range g.order {
+		if found[step] {
+			dependents = append(dependents, step)
+		}
+	}
+	return dependents
+}
+
+// logProgress logs what running steps are waiting for, and what pending steps
+// are blocked on
+func (g *Graph) logProgress() {
+	for _, name := range g.order {
+		st := g.states[name]
+		switch st.state {
+		case Running:
+			waiting := st.current.progress.Waiting()
+			if len(waiting) == 0 {
+				waiting = []string{"nothing reported"}
+			}
+			log.Printf("Step %s running for %s, waiting for: %s", name, time.Since(st.current.started).Round(time.Second), strings.Join(waiting, ", "))
+		case Pending:
+			if wait := time.Until(st.retryAt); wait > 0 {
+				log.Printf("Step %s failed, retrying in %s: %v", name, wait.Round(time.Second), st.err)
+				continue
+			}
+			var blocked []string
+			for _, dep := range g.steps[name].DependsOn {
+				if state := g.states[dep].state; state != Complete && state != Degraded {
+					blocked = append(blocked, dep)
+				}
+			}
+			if len(blocked) > 0 {
+				log.Printf("Step %s pending on steps: %s", name, strings.Join(blocked, ", "))
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package steps
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher/lasso/pkg/controller"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// startOnly is a factory without controllers, the handlers of the tests are
+// registered on a handlers instead
+type startOnly struct {
+	controller.SharedControllerFactory
+}
+
+func (startOnly) Start(context.Context, int) error {
+	return nil
+}
+
+// handlers stands in for the SharedHandler of a controller: like lasso, a
+// handler is removed from a goroutine once the ctx it was registered with is
+// done, and OnChange is what the controller does for every event.
+//
+// lasso's SharedHandler isn't used since its removal modifies the slice
+// OnChange is reading, which -race reports when events keep coming.
+type handlers struct {
+	lock     sync.Mutex
+	handlers map[string]func()
+}
+
+func (h *handlers) Register(ctx context.Context, name string, handler func()) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.handlers == nil {
+		h.handlers = map[string]func(){}
+	}
+	h.handlers[name] = handler
+
+	go func() {
+		<-ctx.Done()
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		delete(h.handlers, name)
+	}()
+}
+
+func (h *handlers) OnChange() {
+	h.lock.Lock()
+	var handlers []func()
+	for _, handler := range h.handlers {
+		handlers = append(handlers, handler)
+	}
+	h.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+// countingStep returns a step that registers a handler on h, counting its
+// calls in calls. The step completes on the first call.
+func countingStep(name string, h *handlers, calls *atomic.Int32, stepCtx *context.Context) Step {
+	return Step{
+		Name: name,
+		Register: func(ctx context.Context, progress *Progress) error {
+			*stepCtx = ctx
+			h.Register(ctx, name, func() {
+				calls.Add(1)
+				progress.Complete()
+			})
+			return nil
+		},
+	}
+}
+
+func TestStopOnComplete(t *testing.T) {
+	h := &handlers{}
+
+	var stoppedCalls, keptCalls atomic.Int32
+	var stoppedCtx, keptCtx context.Context
+	stopped := countingStep("stopped", h, &stoppedCalls, &stoppedCtx)
+	stopped.StopOnComplete = true
+	kept := countingStep("kept", h, &keptCalls, &keptCtx)
+
+	g := NewGraph(startOnly{}, 1)
+	g.ProgressInterval = 0
+	for _, step := range []Step{stopped, kept} {
+		if err := g.Add(step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Run(ctx)
+	}()
+	// Both steps are registered right away. Like the controllers, send
+	// events once the factory is started, until both steps completed.
+	var err error
+	for running := true; running; {
+		select {
+		case err = <-done:
+			running = false
+		case <-time.After(10 * time.Millisecond):
+			if g.FactoryStarted() {
+				h.OnChange()
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stoppedCtx.Err() == nil {
+		t.Fatal("context of the StopOnComplete step wasn't cancelled")
+	}
+	if keptCtx.Err() != nil {
+		t.Fatal("context of the other step was cancelled")
+	}
+	// Handlers are removed from a goroutine once their context is done, so
+	// send events until one doesn't reach the handler
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		before := stoppedCalls.Load()
+		h.OnChange()
+		return stoppedCalls.Load() == before, nil
+	})
+	if err != nil {
+		t.Fatalf("StopOnComplete handler still called: %v", err)
+	}
+
+	before := stoppedCalls.Load()
+	keptBefore := keptCalls.Load()
+	for range 3 {
+		h.OnChange()
+	}
+	if got := stoppedCalls.Load(); got != before {
+		t.Errorf("StopOnComplete handler called %d times after the step completed, want 0", got-before)
+	}
+	if got := keptCalls.Load() - keptBefore; got != 3 {
+		t.Errorf("other handler called %d times after the step completed, want 3", got)
+	}
+}
@@ -0,0 +1,129 @@
+package steps
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	wcorev1 "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// Store persists which steps are complete, so that a restart doesn't redo
+// them
+type Store interface {
+	// Completed returns the names of the steps recorded as complete
+	Completed() ([]string, error)
+	// MarkComplete records the step as complete
+	MarkComplete(step string) error
+	// Forget removes the records of the steps
+	Forget(steps ...string) error
+}
+
+const (
+	// versionKey holds the version the steps were completed with
+	versionKey = "version"
+	// stepKeyPrefix prefixes the keys of steps, which hold the time they
+	// completed at
+	stepKeyPrefix = "step."
+)
+
+// ConfigMapStore records complete steps in a ConfigMap, eg:
+//
+//	data:
+//	  version: "1"
+//	  step.step-1: "2024-05-02T10:00:00Z"
+//	  step.step-2: "2024-05-02T10:01:12Z"
+//
+// Records are only trusted if they have the same version as the store. Bump
+// the version when steps change in a way that requires running them again,
+// eg: a step now owns more objects.
+type ConfigMapStore struct {
+	client    wcorev1.ConfigMapClient
+	namespace string
+	name      string
+	version   string
+}
+
+func NewConfigMapStore(client wcorev1.ConfigMapClient, namespace, name, version string) *ConfigMapStore {
+	return &ConfigMapStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		version:   version,
+	}
+}
+
+func (s *ConfigMapStore) Completed() ([]string, error) {
+	cm, err := s.client.Get(s.namespace, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if version := cm.Data[versionKey]; version != s.version {
+		log.Printf("Ignoring steps completed with version %q, running version %q", version, s.version)
+		return nil, nil
+	}
+
+	var completed []string
+	for key := range cm.Data {
+		if step, ok := strings.CutPrefix(key, stepKeyPrefix); ok {
+			completed = append(completed, step)
+		}
+	}
+	return completed, nil
+}
+
+func (s *ConfigMapStore) MarkComplete(step string) error {
+	return s.update(func(data map[string]string) {
+		data[stepKeyPrefix+step] = time.Now().UTC().Format(time.RFC3339)
+	})
+}
+
+func (s *ConfigMapStore) Forget(steps ...string) error {
+	return s.update(func(data map[string]string) {
+		for _, step := range steps {
+			delete(data, stepKeyPrefix+step)
+		}
+	})
+}
+
+// update creates or updates the ConfigMap. Records of another version are
+// dropped.
+func (s *ConfigMapStore) update(mutate func(data map[string]string)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := s.client.Get(s.namespace, s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+				},
+				Data: map[string]string{
+					versionKey: s.version,
+				},
+			}
+			mutate(cm.Data)
+			_, err = s.client.Create(cm)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		cm = cm.DeepCopy()
+		if cm.Data == nil || cm.Data[versionKey] != s.version {
+			cm.Data = map[string]string{
+				versionKey: s.version,
+			}
+		}
+		mutate(cm.Data)
+		_, err = s.client.Update(cm)
+		return err
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// countingTransport counts the bytes of every response body read through it.
+//
+// It sits above the transport that handles gzip, so it counts decoded bytes,
+// which is what the client has to parse. The apiserver gzips large responses,
+// so see countingConn for what actually goes over the wire.
+type countingTransport struct {
+	next  http.RoundTripper
+	bytes atomic.Int64
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = &countingReader{ReadCloser: resp.Body, count: &c.bytes}
+	return resp, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count.Add(int64(n))
+	return n, err
+}
+
+// countingConn counts the bytes read from a connection, ie: what went over the
+// wire, compressed and encrypted, headers and TLS handshake included
+type countingConn struct {
+	net.Conn
+	count *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+// countingDial wraps dial, or a default dialer if nil, so that connections
+// count the bytes read into count
+func countingDial(dial func(ctx context.Context, network, address string) (net.Conn, error), count *atomic.Int64) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, count: count}, nil
+	}
+}
+
+// compareMode is one way of listing and watching the same resource
+type compareMode struct {
+	name  string
+	list  negotiation
+	watch negotiation
+}
+
+var compareModes = []compareMode{
+	{
+		name: "Full objects",
+	},
+	{
+		name:  "Metadata only",
+		list:  negotiation{Format: formatPartialObjectMetadataList},
+		watch: negotiation{Format: formatPartialObjectMetadata},
+	},
+	{
+		name:  "Table, include Object",
+		list:  negotiation{Format: formatTable, IncludeObject: metav1.IncludeObject},
+		watch: negotiation{Format: formatTable, IncludeObject: metav1.IncludeObject},
+	},
+	{
+		name:  "Table, include Metadata",
+		list:  negotiation{Format: formatTable, IncludeObject: metav1.IncludeMetadata},
+		watch: negotiation{Format: formatTable, IncludeObject: metav1.IncludeMetadata},
+	},
+	{
+		name:  "Table, include None",
+		list:  negotiation{Format: formatTable, IncludeObject: metav1.IncludeNone},
+		watch: negotiation{Format: formatTable, IncludeObject: metav1.IncludeNone},
+	},
+}
+
+type compareResult struct {
+	mode           string
+	listWire       int64
+	listDecoded    int64
+	listRows       int
+	listTime       time.Duration
+	watchWire      int64
+	watchDecoded   int64
+	watchEvents    int
+	firstEventTime time.Duration
+	err            error
+}
+
+// compareBandwidth lists and watches the resource once per mode and prints how
+// many bytes each one needed, both on the wire and once decoded. Each mode uses
+// its own connection, so the list's wire bytes include the TLS handshake.
+//
+// The watch starts without a resourceVersion, so the server first sends every
+// existing object as an ADDED event. The time to the first event is then the
+// time until a UI could show its first row. The watch is stopped after
+// watchDuration.
+func compareBandwidth(ctx context.Context, config *rest.Config, gvr schema.GroupVersionResource, namespace string, opts metav1.ListOptions, watchDuration time.Duration) error {
+	var results []compareResult
+	for _, mode := range compareModes {
+		fmt.Fprintf(os.Stderr, "Comparing %s\n", mode.name)
+		results = append(results, compareOne(ctx, config, gvr, namespace, opts, watchDuration, mode))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 3, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "MODE\tLIST WIRE BYTES\tLIST DECODED BYTES\tLIST ROWS\tLIST TIME\tWATCH WIRE BYTES\tWATCH DECODED BYTES\tWATCH EVENTS\tFIRST EVENT")
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(w, "%s\terror: %v\t\t\t\t\t\t\t\n", r.mode, r.err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%d\t%d\t%d\t%s\n",
+			r.mode,
+			r.listWire, r.listDecoded, r.listRows, r.listTime.Round(time.Millisecond),
+			r.watchWire, r.watchDecoded, r.watchEvents, r.firstEventTime.Round(time.Millisecond))
+	}
+	return w.Flush()
+}
+
+func compareOne(ctx context.Context, config *rest.Config, gvr schema.GroupVersionResource, namespace string, opts metav1.ListOptions, watchDuration time.Duration, mode compareMode) compareResult {
+	result := compareResult{mode: mode.name}
+
+	counter := &countingTransport{}
+	var wire atomic.Int64
+	cfg := rest.CopyConfig(config)
+	// Also gives each mode its own transport, client-go can't share
+	// transports with a custom Dial
+	cfg.Dial = countingDial(cfg.Dial, &wire)
+	cfg.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		counter.next = newNegotiatingTransport(rt, mode.list, negotiationRule{
+			Verbs:       []string{"watch"},
+			negotiation: mode.watch,
+		})
+		return counter
+	})
+	dynClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	var resInt dynamic.ResourceInterface = dynClient.Resource(gvr)
+	if namespace != "" {
+		resInt = dynClient.Resource(gvr).Namespace(namespace)
+	}
+
+	// No tablelistconvert here: it drops the rows of include None, and we
+	// only need to count them
+	start := time.Now()
+	list, err := resInt.List(ctx, opts)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.listTime = time.Since(start)
+	result.listWire = wire.Swap(0)
+	result.listDecoded = counter.bytes.Swap(0)
+	result.listRows = countRows(list)
+
+	watchCtx, cancel := context.WithTimeout(ctx, watchDuration)
+	defer cancel()
+	start = time.Now()
+	watcher, err := resInt.Watch(watchCtx, metav1.ListOptions{
+		LabelSelector: opts.LabelSelector,
+		FieldSelector: opts.FieldSelector,
+	})
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case _, ok := <-watcher.ResultChan():
+			if !ok {
+				result.watchWire = wire.Load()
+				result.watchDecoded = counter.bytes.Load()
+				if watchCtx.Err() == nil {
+					result.err = errors.New("watch closed early")
+				}
+				return result
+			}
+			if result.watchEvents == 0 {
+				result.firstEventTime = time.Since(start)
+			}
+			result.watchEvents++
+		case <-watchCtx.Done():
+			result.watchWire = wire.Load()
+			result.watchDecoded = counter.bytes.Load()
+			return result
+		}
+	}
+}
+
+// countRows counts the rows of a Table, or the items of any other list
+func countRows(list *unstructured.UnstructuredList) int {
+	if rows, ok := list.Object["rows"].([]interface{}); ok {
+		return len(rows)
+	}
+	return len(list.Items)
+}
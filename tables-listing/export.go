@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// exportFormat is a format to hand the table over to someone else
+type exportFormat string
+
+const (
+	exportCSV       exportFormat = "csv"
+	exportMarkdown  exportFormat = "markdown"
+	exportJSONLines exportFormat = "jsonl"
+)
+
+// listEvent is the event type of rows coming from a list rather than a watch
+const listEvent = "LIST"
+
+// tableExporter writes rows as CSV, Markdown or JSON Lines.
+//
+// Unlike tableRenderer, it never redraws: rows are appended as they come,
+// with an Event column telling whether the row comes from a list or from an
+// ADDED, MODIFIED or DELETED watch event. Every column is exported, whatever
+// its priority.
+type tableExporter struct {
+	out    io.Writer
+	csv    *csv.Writer
+	format exportFormat
+	// namespaced adds a Namespace column, which Tables don't have
+	namespaced bool
+
+	// columns are the ones of the first list. The header is only written
+	// once, so a relist doesn't change them.
+	columns []metav1.TableColumnDefinition
+}
+
+func newTableExporter(out io.Writer, format exportFormat, namespaced bool) (*tableExporter, error) {
+	switch format {
+	case exportCSV, exportMarkdown, exportJSONLines:
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	return &tableExporter{
+		out:        out,
+		csv:        csv.NewWriter(out),
+		format:     format,
+		namespaced: namespaced,
+	}, nil
+}
+
+// SetList writes the header the first time, then every row of the list
+func (e *tableExporter) SetList(list *unstructured.UnstructuredList) error {
+	if e.columns == nil {
+		columns, err := columnDefinitions(list)
+		if err != nil {
+			return err
+		}
+		e.columns = columns
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	for i := range list.Items {
+		if err := e.writeRow(listEvent, &list.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleEvent writes the row of a watch event. Events that aren't about a
+// row, eg: bookmarks, are skipped.
+func (e *tableExporter) HandleEvent(event watch.Event) error {
+	obj, ok := event.Object.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+	switch event.Type {
+	case watch.Added, watch.Modified, watch.Deleted:
+		return e.writeRow(string(event.Type), obj)
+	}
+	return nil
+}
+
+func (e *tableExporter) headers() []string {
+	headers := []string{"Event"}
+	if e.namespaced {
+		headers = append(headers, "Namespace")
+	}
+	for _, column := range e.columns {
+		headers = append(headers, column.Name)
+	}
+	return headers
+}
+
+func (e *tableExporter) writeHeader() error {
+	headers := e.headers()
+	switch e.format {
+	case exportCSV:
+		return e.writeCSV(headers)
+	case exportMarkdown:
+		separators := make([]string, len(headers))
+		for i := range separators {
+			separators[i] = "---"
+		}
+		if err := e.writeMarkdown(headers); err != nil {
+			return err
+		}
+		return e.writeMarkdown(separators)
+	}
+	// JSON Lines has no header, every line has the column names as keys
+	return nil
+}
+
+func (e *tableExporter) writeRow(event string, obj *unstructured.Unstructured) error {
+	cells := rowCells(obj)
+
+	if e.format == exportJSONLines {
+		row := map[string]interface{}{
+			"Event": event,
+		}
+		if e.namespaced {
+			row["Namespace"] = obj.GetNamespace()
+		}
+		for i, column := range e.columns {
+			row[column.Name] = cellAt(cells, i)
+		}
+		return json.NewEncoder(e.out).Encode(row)
+	}
+
+	values := []string{event}
+	if e.namespaced {
+		values = append(values, obj.GetNamespace())
+	}
+	for i := range e.columns {
+		values = append(values, formatCell(cells, i))
+	}
+	if e.format == exportCSV {
+		return e.writeCSV(values)
+	}
+	return e.writeMarkdown(values)
+}
+
+// writeCSV writes and flushes a record, so that rows show up as soon as the
+// watch sees them
+func (e *tableExporter) writeCSV(record []string) error {
+	if err := e.csv.Write(record); err != nil {
+		return err
+	}
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+// markdownEscaper keeps cells from breaking the table
+var markdownEscaper = strings.NewReplacer("|", `\|`, "\r\n", " ", "\n", " ")
+
+func (e *tableExporter) writeMarkdown(values []string) error {
+	escaped := make([]string, 0, len(values))
+	for _, value := range values {
+		escaped = append(escaped, markdownEscaper.Replace(value))
+	}
+	_, err := fmt.Fprintf(e.out, "| %s |\n", strings.Join(escaped, " | "))
+	return err
+}
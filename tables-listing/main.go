@@ -7,17 +7,39 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/rancher/steve/pkg/stores/proxyalpha/tablelistconvert"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
-	include = flag.String("include", "Object", "One of Object, Metadata, None")
+	include    = flag.String("include", "Object", "One of Object, Metadata, None")
+	includeFor = flag.String("include-for", "", "Per-resource include overrides, eg: pods=Metadata,deployments.apps=None")
+	output     = flag.String("o", "json", "One of json, table, wide, csv, markdown, jsonl. table and wide redraw the table on every watch event, csv, markdown and jsonl append a row per watch event")
+
+	resource      = flag.String("resource", "namespaces", "Resource to list: plural (pods), short name (po) or resource.group (deployments.apps)")
+	group         = flag.String("group", "", "Group of the resource, empty to let discovery find it")
+	version       = flag.String("version", "", "Version of the resource, empty for the preferred version")
+	namespace     = flag.String("n", "", "Namespace to list from, empty for all namespaces")
+	labelSelector = flag.String("l", "", "Label selector")
+	fieldSelector = flag.String("field-selector", "", "Field selector")
+	limit         = flag.Int64("limit", 0, "Page size, 0 to list everything in one request")
+	continueToken = flag.String("continue", "", "Continue token of a previous paginated list to start from")
+
+	contexts = flag.String("contexts", "", "Comma separated kubeconfig contexts to list from concurrently, merged into one table with a Cluster column. Empty for the current context only")
+
+	serve = flag.String("serve", "", "If set (eg: localhost:8080), serve the sorted, filtered and paginated table at /table")
+
+	compare              = flag.Bool("compare", false, "Compare bytes, on the wire and decoded, used by full objects, metadata-only and Table listing, then exit")
+	compareWatchDuration = flag.Duration("compare-watch-duration", 5*time.Second, "How long to watch for in each -compare mode")
 )
 
 func must(err error) {
@@ -26,75 +48,187 @@ func must(err error) {
 	}
 }
 
-type addQuery struct {
-	values map[string]string
-	next   http.RoundTripper
-}
+func main() {
+	flag.Parse()
 
-func (a *addQuery) RoundTrip(req *http.Request) (*http.Response, error) {
-	q := req.URL.Query()
-	for k, v := range a.values {
-		q.Set(k, v)
+	var clusters []string
+	if *contexts != "" {
+		clusters = strings.Split(*contexts, ",")
 	}
-	req.Header.Set("Accept", "application/json;as=Table;v=v1;g=meta.k8s.io,application/json;as=Table;v=v1beta1;g=meta.k8s.io")
-	req.URL.RawQuery = q.Encode()
-	return a.next.RoundTrip(req)
-}
 
-func main() {
-	flag.Parse()
+	var (
+		config     *rest.Config
+		gvr        schema.GroupVersionResource
+		namespaced bool
+		err        error
+	)
+	if len(clusters) == 0 {
+		config, err = clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+		must(err)
+		gvr, namespaced, err = resolveResource(config, *resource, *group, *version)
+		must(err)
+	} else {
+		config, gvr, namespaced, err = resolveInClusters(clusters)
+		must(err)
+	}
+	fmt.Fprintf(os.Stderr, "Listing %s\n", gvr)
 
-	config, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	includeRules, err := parseIncludeRules(*includeFor)
 	must(err)
-
 	setTable := func(rt http.RoundTripper) http.RoundTripper {
-		return &addQuery{
-			values: map[string]string{
-				"includeObject": *include,
-			},
-			next: rt,
+		return newNegotiatingTransport(rt, negotiation{
+			Format:        formatTable,
+			IncludeObject: metav1.IncludeObjectPolicy(*include),
+		}, includeRules...)
+	}
+
+	// Ctrl-C stops the watch cleanly instead of killing the process mid-write
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listOpts := metav1.ListOptions{
+		LabelSelector: *labelSelector,
+		FieldSelector: *fieldSelector,
+		Limit:         *limit,
+		Continue:      *continueToken,
+	}
+
+	if *compare {
+		compareNamespace := ""
+		if namespaced {
+			compareNamespace = *namespace
 		}
+		must(compareBandwidth(ctx, config, gvr, compareNamespace, listOpts, *compareWatchDuration))
+		return
 	}
 
-	tableClientCfg := rest.CopyConfig(config)
-	tableClientCfg.Wrap(setTable)
-	// tableClientCfg.AcceptContentTypes = "application/json;as=Table;v=v1;g=meta.k8s.io,application/json;as=Table;v=v1beta1;g=meta.k8s.io"
-	dynClient, err := dynamic.NewForConfig(tableClientCfg)
-	must(err)
+	var renderer *tableRenderer
+	var exporter *tableExporter
+	switch *output {
+	case "json":
+	case "table", "wide":
+		renderer = newTableRenderer(os.Stdout, *output == "wide", true)
+	default:
+		exporter, err = newTableExporter(os.Stdout, exportFormat(*output), namespaced)
+		must(err)
+	}
 
-	resInt := dynClient.Resource(schema.GroupVersionResource{
-		Group:    "",
-		Version:  "v1",
-		Resource: "namespaces",
-	})
+	var cache *tableCache
+	if *serve != "" {
+		cache = newTableCache()
+	}
+	startServer := func() {
+		if cache == nil {
+			return
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/table", cache)
+		go func() {
+			must(http.ListenAndServe(*serve, mux))
+		}()
+		fmt.Fprintf(os.Stderr, "Serving table at http://%s/table\n", *serve)
+	}
 
-	ctx := context.Background()
+	// setRows gives every row to the outputs that keep them all
+	setRows := func(list *unstructured.UnstructuredList) error {
+		if cache != nil {
+			if err := cache.SetList(list); err != nil {
+				return err
+			}
+		}
+		if renderer != nil {
+			if err := renderer.SetList(list); err != nil {
+				return err
+			}
+			return renderer.Render()
+		}
+		return nil
+	}
+	// updateRows gives a single event to the outputs that keep every row
+	updateRows := func(event watch.Event) error {
+		if cache != nil {
+			cache.HandleEvent(event)
+		}
+		if renderer != nil && renderer.HandleEvent(event) {
+			return renderer.Render()
+		}
+		return nil
+	}
+	// emitList and emitEvent are for the outputs that only append
+	emitList := func(list *unstructured.UnstructuredList) error {
+		switch {
+		case exporter != nil:
+			return exporter.SetList(list)
+		case renderer == nil:
+			fmt.Fprintln(os.Stderr, "List")
+			printJSON(list)
+		}
+		return nil
+	}
+	emitEvent := func(event watch.Event) error {
+		switch {
+		case exporter != nil:
+			return exporter.HandleEvent(event)
+		case renderer == nil:
+			printJSON(event)
+		}
+		return nil
+	}
 
-	table := tablelistconvert.Client{ResourceInterface: resInt}
-	stuff, err := table.List(ctx, metav1.ListOptions{})
-	must(err)
+	if len(clusters) > 0 {
+		startServer()
+		fmt.Fprintf(os.Stderr, "Watching %d clusters\n", len(clusters))
+		newClusterTable(clusters, setRows, emitList, updateRows, emitEvent).Run(ctx, func(cluster string) (*tableWatcher, error) {
+			config, err := clusterConfig(cluster)
+			if err != nil {
+				return nil, err
+			}
+			gvr, namespaced, err := resolveResource(config, *resource, *group, *version)
+			if err != nil {
+				return nil, err
+			}
+			table, err := newTableClient(config, gvr, namespaced, setTable)
+			if err != nil {
+				return nil, err
+			}
+			return &tableWatcher{Name: cluster, table: table, opts: listOpts}, nil
+		})
+		return
+	}
 
-	bytes, err := json.Marshal(stuff)
+	table, err := newTableClient(config, gvr, namespaced, setTable)
 	must(err)
 
-	fmt.Fprintln(os.Stderr, "Initial list")
-	fmt.Println(string(bytes))
+	watcher := &tableWatcher{
+		table: table,
+		opts:  listOpts,
+		OnList: func(list *unstructured.UnstructuredList) error {
+			if err := setRows(list); err != nil {
+				return err
+			}
+			return emitList(list)
+		},
+		OnEvent: func(event watch.Event) error {
+			if err := updateRows(event); err != nil {
+				return err
+			}
+			return emitEvent(event)
+		},
+	}
+	must(watcher.List(ctx))
+	startServer()
 
 	fmt.Fprintln(os.Stderr, "Starting a watch")
-	watcher, err := table.Watch(ctx, metav1.ListOptions{
-		ResourceVersion: stuff.GetResourceVersion(),
-	})
-	must(err)
-
-	for {
-		select {
-		case it := <-watcher.ResultChan():
-			bytes, err = json.Marshal(it)
-			must(err)
+	must(watcher.Run(ctx))
+}
 
-			fmt.Println(string(bytes))
-		case <-ctx.Done():
-			return
-		}
+// printJSON prints v on a single line. A value that can't be marshalled is
+// reported but doesn't stop the watch.
+func printJSON(v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to marshal %T: %v\n", v, err)
+		return
 	}
+	fmt.Println(string(bytes))
 }
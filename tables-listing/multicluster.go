@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// clusterRetryDelay is how long to wait before trying again a cluster that
+// couldn't be listed
+const clusterRetryDelay = 10 * time.Second
+
+// clusterMaxFailures is how many watches in a row can fail before a cluster is
+// considered down, its rows removed and the cluster retried from a new list
+const clusterMaxFailures = 3
+
+// clusterAnnotation is set on every row to the cluster it was listed from, so
+// that rows of different clusters with the same namespace/name are kept apart
+const clusterAnnotation = "tables-listing/cluster"
+
+// clusterColumn is added in front of the Table columns, so that rows of all
+// clusters can be shown in a single table
+var clusterColumn = map[string]interface{}{
+	"name":        "Cluster",
+	"type":        "string",
+	"format":      "",
+	"description": "Kubeconfig context the row was listed from",
+	"priority":    int64(0),
+}
+
+// clusterConfig loads the config of a kubeconfig context, using the same
+// kubeconfig files as kubectl
+func clusterConfig(context string) (*rest.Config, error) {
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: context},
+	).ClientConfig()
+}
+
+// resolveInClusters resolves the resource in the first cluster where that
+// works. Each cluster still resolves it on its own when listing, since the
+// preferred version can differ.
+func resolveInClusters(clusters []string) (*rest.Config, schema.GroupVersionResource, bool, error) {
+	var errs []error
+	for _, cluster := range clusters {
+		config, err := clusterConfig(cluster)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", cluster, err))
+			continue
+		}
+		gvr, namespaced, err := resolveResource(config, *resource, *group, *version)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", cluster, err))
+			continue
+		}
+		return config, gvr, namespaced, nil
+	}
+	return nil, schema.GroupVersionResource{}, false, fmt.Errorf("no cluster could resolve %s: %v", *resource, errs)
+}
+
+// clusterTable merges the Tables of several clusters into one, with a Cluster
+// column.
+//
+// The Cluster column is added to the rows themselves, so the outputs don't
+// need to know about clusters. Outputs that only append (json, exporters)
+// get each cluster's lists and events as they come. Outputs that keep every
+// row (renderer, cache) get the events as they come too, but are given the
+// merged list after a list or when a cluster is forgotten, since a relist in
+// one cluster must not drop the rows of the others. Rows of different clusters
+// can have the same namespace/name, so they're told apart by
+// clusterAnnotation, see rowKey.
+type clusterTable struct {
+	clusters []string
+
+	// setRows, updateRows, emitList and emitEvent are never called
+	// concurrently
+	setRows    func(*unstructured.UnstructuredList) error
+	updateRows func(watch.Event) error
+	emitList   func(*unstructured.UnstructuredList) error
+	emitEvent  func(watch.Event) error
+
+	lock  sync.Mutex
+	lists map[string]*unstructured.UnstructuredList
+}
+
+func newClusterTable(clusters []string, setRows, emitList func(*unstructured.UnstructuredList) error, updateRows, emitEvent func(watch.Event) error) *clusterTable {
+	return &clusterTable{
+		clusters:   clusters,
+		setRows:    setRows,
+		updateRows: updateRows,
+		emitList:   emitList,
+		emitEvent:  emitEvent,
+		lists:      map[string]*unstructured.UnstructuredList{},
+	}
+}
+
+// Run lists and watches every cluster concurrently until ctx is cancelled.
+//
+// A cluster that fails to list, or to watch clusterMaxFailures times in a row,
+// is retried on its own, and its rows are removed in the meantime so that
+// nothing stale is shown. The other clusters keep going.
+func (c *clusterTable) Run(ctx context.Context, newWatcher func(cluster string) (*tableWatcher, error)) {
+	var wg sync.WaitGroup
+	for _, cluster := range c.clusters {
+		wg.Add(1)
+		go func(cluster string) {
+			defer wg.Done()
+			c.runCluster(ctx, cluster, newWatcher)
+		}(cluster)
+	}
+	wg.Wait()
+}
+
+func (c *clusterTable) runCluster(ctx context.Context, cluster string, newWatcher func(cluster string) (*tableWatcher, error)) {
+	for ctx.Err() == nil {
+		err := c.watchCluster(ctx, cluster, newWatcher)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "[%s] Failed, retrying in %s: %v\n", cluster, clusterRetryDelay, err)
+		if err := c.forget(cluster); err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] Failed to remove rows: %v\n", cluster, err)
+		}
+		sleep(ctx, clusterRetryDelay)
+	}
+}
+
+func (c *clusterTable) watchCluster(ctx context.Context, cluster string, newWatcher func(cluster string) (*tableWatcher, error)) error {
+	watcher, err := newWatcher(cluster)
+	if err != nil {
+		return err
+	}
+	watcher.MaxFailures = clusterMaxFailures
+	watcher.OnList = func(list *unstructured.UnstructuredList) error {
+		return c.onList(cluster, list)
+	}
+	watcher.OnEvent = func(event watch.Event) error {
+		return c.onEvent(cluster, event)
+	}
+	if err := watcher.List(ctx); err != nil {
+		return err
+	}
+	return watcher.Run(ctx)
+}
+
+func (c *clusterTable) onList(cluster string, list *unstructured.UnstructuredList) error {
+	if columns, ok := list.Object["columnDefinitions"].([]interface{}); ok {
+		list.Object["columnDefinitions"] = append([]interface{}{clusterColumn}, columns...)
+	}
+	for i := range list.Items {
+		setCluster(&list.Items[i], cluster)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lists[cluster] = list
+	if err := c.emitList(list); err != nil {
+		return err
+	}
+	return c.setRows(c.merged())
+}
+
+func (c *clusterTable) onEvent(cluster string, event watch.Event) error {
+	obj, ok := event.Object.(*unstructured.Unstructured)
+	if ok {
+		setCluster(obj, cluster)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ok {
+		applyEvent(c.lists[cluster], event.Type, obj)
+	}
+	if err := c.updateRows(event); err != nil {
+		return err
+	}
+	return c.emitEvent(event)
+}
+
+func (c *clusterTable) forget(cluster string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.lists[cluster]; !ok {
+		return nil
+	}
+	delete(c.lists, cluster)
+	return c.setRows(c.merged())
+}
+
+// merged returns the rows of every cluster, in the order the clusters were
+// given. The columns are the ones of the first cluster.
+func (c *clusterTable) merged() *unstructured.UnstructuredList {
+	merged := &unstructured.UnstructuredList{
+		Object: map[string]interface{}{
+			"columnDefinitions": []interface{}{clusterColumn},
+		},
+	}
+	first := true
+	for _, cluster := range c.clusters {
+		list, ok := c.lists[cluster]
+		if !ok {
+			continue
+		}
+		if first {
+			merged.Object["columnDefinitions"] = list.Object["columnDefinitions"]
+			first = false
+		}
+		merged.Items = append(merged.Items, list.Items...)
+	}
+	return merged
+}
+
+// setCluster adds the cluster in front of the cells stored by
+// tablelistconvert, and sets clusterAnnotation. Objects without cells, eg:
+// bookmarks, are left alone.
+func setCluster(obj *unstructured.Unstructured, cluster string) {
+	cells, found, _ := unstructured.NestedSlice(obj.Object, "metadata", "fields")
+	if !found {
+		return
+	}
+	_ = unstructured.SetNestedSlice(obj.Object, append([]interface{}{cluster}, cells...), "metadata", "fields")
+	_ = unstructured.SetNestedField(obj.Object, cluster, "metadata", "annotations", clusterAnnotation)
+}
+
+// applyEvent updates the items of list with a watch event
+func applyEvent(list *unstructured.UnstructuredList, eventType watch.EventType, obj *unstructured.Unstructured) {
+	if list == nil {
+		return
+	}
+	key := rowKey(obj)
+	for i := range list.Items {
+		if rowKey(&list.Items[i]) != key {
+			continue
+		}
+		switch eventType {
+		case watch.Added, watch.Modified:
+			list.Items[i] = *obj
+		case watch.Deleted:
+			list.Items = append(list.Items[:i], list.Items[i+1:]...)
+		}
+		return
+	}
+	if eventType == watch.Added || eventType == watch.Modified {
+		list.Items = append(list.Items, *obj)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// tableListRow returns a row the way tablelistconvert returns it
+func tableListRow(namespace, name string, cells ...interface{}) unstructured.Unstructured {
+	return unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "meta.k8s.io/v1",
+		"kind":       "PartialObjectMetadata",
+		"metadata": map[string]interface{}{
+			"namespace": namespace,
+			"name":      name,
+			"fields":    cells,
+		},
+	}}
+}
+
+func tableList(rows ...unstructured.Unstructured) *unstructured.UnstructuredList {
+	return &unstructured.UnstructuredList{
+		Object: map[string]interface{}{
+			"columnDefinitions": []interface{}{
+				map[string]interface{}{"name": "Name", "type": "string", "format": "name", "priority": int64(0)},
+				map[string]interface{}{"name": "Status", "type": "string", "format": "", "priority": int64(0)},
+			},
+		},
+		Items: rows,
+	}
+}
+
+func TestClusterTableSameName(t *testing.T) {
+	var out bytes.Buffer
+	renderer := newTableRenderer(&out, false, false)
+	// The rows are only rebuilt on lists, events are given to the renderer
+	// as they come
+	rebuilds := 0
+	setRows := func(list *unstructured.UnstructuredList) error {
+		rebuilds++
+		return renderer.SetList(list)
+	}
+	updateRows := func(event watch.Event) error {
+		renderer.HandleEvent(event)
+		return nil
+	}
+	ignoreList := func(*unstructured.UnstructuredList) error { return nil }
+	ignoreEvent := func(watch.Event) error { return nil }
+	c := newClusterTable([]string{"east", "west"}, setRows, ignoreList, updateRows, ignoreEvent)
+
+	if err := c.onList("east", tableList(tableListRow("default", "nginx", "nginx", "Running"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.onList("west", tableList(tableListRow("default", "nginx", "nginx", "Pending"))); err != nil {
+		t.Fatal(err)
+	}
+	assertRows(t, renderer, &out, "east nginx Running", "west nginx Pending")
+
+	modified := tableListRow("default", "nginx", "nginx", "Failed")
+	if err := c.onEvent("west", watch.Event{Type: watch.Modified, Object: &modified}); err != nil {
+		t.Fatal(err)
+	}
+	assertRows(t, renderer, &out, "east nginx Running", "west nginx Failed")
+
+	deleted := tableListRow("default", "nginx", "nginx", "Running")
+	if err := c.onEvent("east", watch.Event{Type: watch.Deleted, Object: &deleted}); err != nil {
+		t.Fatal(err)
+	}
+	assertRows(t, renderer, &out, "west nginx Failed")
+	if rebuilds != 2 {
+		t.Errorf("rows rebuilt %d times, want 2, once per list", rebuilds)
+	}
+
+	if err := c.forget("west"); err != nil {
+		t.Fatal(err)
+	}
+	assertRows(t, renderer, &out)
+}
+
+// assertRows renders the table and compares its rows, without the header, with
+// want. Cells are separated by a single space.
+func assertRows(t *testing.T, renderer *tableRenderer, out *bytes.Buffer, want ...string) {
+	t.Helper()
+	out.Reset()
+	if err := renderer.Render(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")[1:]
+	got := make([]string, 0, len(lines))
+	for _, line := range lines {
+		got = append(got, strings.Join(strings.Fields(line), " "))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// clearScreen moves the cursor to the top left and clears the terminal, so
+// that each redraw replaces the previous one
+const clearScreen = "\033[H\033[2J"
+
+// tableRenderer prints rows the way `kubectl get` does.
+//
+// tablelistconvert.Client turns each row of the Table into the row's object,
+// with the cells stored in .metadata.fields. The column definitions are only
+// in the Table returned by List, so they must be set from there.
+//
+// Note that tablelistconvert drops rows that have no object, so nothing is
+// shown with -include None.
+type tableRenderer struct {
+	out  io.Writer
+	wide bool
+	// live clears the screen before each redraw
+	live bool
+
+	columns []metav1.TableColumnDefinition
+	rows    map[string][]interface{}
+	// order keeps rows in the order they were first seen, like kubectl
+	order []string
+}
+
+func newTableRenderer(out io.Writer, wide, live bool) *tableRenderer {
+	return &tableRenderer{
+		out:  out,
+		wide: wide,
+		live: live,
+		rows: map[string][]interface{}{},
+	}
+}
+
+// columnDefinitions extracts the column definitions of the Table returned
+// by tablelistconvert.Client.List
+func columnDefinitions(list *unstructured.UnstructuredList) ([]metav1.TableColumnDefinition, error) {
+	raw, ok := list.Object["columnDefinitions"]
+	if !ok {
+		return nil, fmt.Errorf("no column definitions, is the server returning a Table?")
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var columns []metav1.TableColumnDefinition
+	if err := json.Unmarshal(data, &columns); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+// rowKey identifies a row across watch events. Rows of a clusterTable are
+// prefixed with their cluster.
+func rowKey(obj *unstructured.Unstructured) string {
+	key := obj.GetName()
+	if obj.GetNamespace() != "" {
+		key = obj.GetNamespace() + "/" + key
+	}
+	if cluster := obj.GetAnnotations()[clusterAnnotation]; cluster != "" {
+		key = cluster + "/" + key
+	}
+	return key
+}
+
+// rowCells returns the cells stored by tablelistconvert in .metadata.fields
+func rowCells(obj *unstructured.Unstructured) []interface{} {
+	cells, _, _ := unstructured.NestedSlice(obj.Object, "metadata", "fields")
+	return cells
+}
+
+// SetList replaces all rows with the ones of the list
+func (t *tableRenderer) SetList(list *unstructured.UnstructuredList) error {
+	columns, err := columnDefinitions(list)
+	if err != nil {
+		return err
+	}
+	t.columns = columns
+	t.rows = map[string][]interface{}{}
+	t.order = nil
+	for i := range list.Items {
+		t.setRow(&list.Items[i])
+	}
+	return nil
+}
+
+// HandleEvent updates the rows with a watch event. It returns false if the
+// event wasn't about a row, eg: a bookmark or an error.
+func (t *tableRenderer) HandleEvent(event watch.Event) bool {
+	obj, ok := event.Object.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	switch event.Type {
+	case watch.Added, watch.Modified:
+		t.setRow(obj)
+	case watch.Deleted:
+		t.deleteRow(rowKey(obj))
+	default:
+		return false
+	}
+	return true
+}
+
+func (t *tableRenderer) setRow(obj *unstructured.Unstructured) {
+	key := rowKey(obj)
+	if _, ok := t.rows[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.rows[key] = rowCells(obj)
+}
+
+func (t *tableRenderer) deleteRow(key string) {
+	if _, ok := t.rows[key]; !ok {
+		return
+	}
+	delete(t.rows, key)
+	for i, k := range t.order {
+		if k == key {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// visibleColumns returns the indexes of the columns to print. Like kubectl,
+// columns with a priority other than 0 are only shown in wide mode.
+func (t *tableRenderer) visibleColumns() []int {
+	var visible []int
+	for i, column := range t.columns {
+		if column.Priority == 0 || t.wide {
+			visible = append(visible, i)
+		}
+	}
+	return visible
+}
+
+// Render prints all rows
+func (t *tableRenderer) Render() error {
+	if t.live {
+		if _, err := fmt.Fprint(t.out, clearScreen); err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(t.out, 3, 0, 3, ' ', 0)
+	visible := t.visibleColumns()
+
+	headers := make([]string, 0, len(visible))
+	for _, i := range visible {
+		headers = append(headers, strings.ToUpper(t.columns[i].Name))
+	}
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+
+	for _, key := range t.order {
+		cells := t.rows[key]
+		values := make([]string, 0, len(visible))
+		for _, i := range visible {
+			values = append(values, formatCell(cells, i))
+		}
+		fmt.Fprintln(w, strings.Join(values, "\t"))
+	}
+	return w.Flush()
+}
+
+// formatCell formats the cell like kubectl: missing cells are shown as
+// <none> and numbers without a trailing .0
+func formatCell(cells []interface{}, i int) string {
+	if i >= len(cells) || cells[i] == nil {
+		return "<none>"
+	}
+	switch v := cells[i].(type) {
+	case string:
+		return v
+	case float64:
+		if v == float64(int64(v)) {
+			return fmt.Sprintf("%d", int64(v))
+		}
+		return fmt.Sprintf("%v", v)
+	case int64:
+		return fmt.Sprintf("%d", v)
+	}
+	return fmt.Sprintf("%v", cells[i])
+}
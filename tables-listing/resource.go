@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rancher/steve/pkg/stores/proxyalpha/tablelistconvert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// resolveResource turns what the user typed (eg: "ns", "deployments.apps",
+// "deploy" with -group apps) into a fully qualified resource using discovery,
+// the same way kubectl does. It also returns whether the resource is namespaced.
+//
+// config must NOT be the Table config: discovery needs regular JSON responses.
+func resolveResource(config *rest.Config, resource, group, version string) (schema.GroupVersionResource, bool, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	mapper := restmapper.NewShortcutExpander(
+		restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+		dc,
+		func(warning string) { fmt.Fprintln(os.Stderr, warning) },
+	)
+
+	partial := schema.GroupVersionResource{
+		Group:    group,
+		Version:  version,
+		Resource: resource,
+	}
+	if group == "" && strings.Contains(resource, ".") {
+		gr := schema.ParseGroupResource(resource)
+		partial.Group = gr.Group
+		partial.Resource = gr.Resource
+	}
+
+	gvr, err := mapper.ResourceFor(partial)
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	gvk, err := mapper.KindFor(gvr)
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	return gvr, mapping.Scope.Name() == meta.RESTScopeNameNamespace, nil
+}
+
+// newTableClient returns a client listing the resource as Tables. wrap must
+// ask for Tables, see negotiatingTransport.
+func newTableClient(config *rest.Config, gvr schema.GroupVersionResource, namespaced bool, wrap func(http.RoundTripper) http.RoundTripper) (*tablelistconvert.Client, error) {
+	tableClientCfg := rest.CopyConfig(config)
+	tableClientCfg.Wrap(wrap)
+	// tableClientCfg.AcceptContentTypes = "application/json;as=Table;v=v1;g=meta.k8s.io,application/json;as=Table;v=v1beta1;g=meta.k8s.io"
+	dynClient, err := dynamic.NewForConfig(tableClientCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var resInt dynamic.ResourceInterface = dynClient.Resource(gvr)
+	if namespaced && *namespace != "" {
+		resInt = dynClient.Resource(gvr).Namespace(*namespace)
+	} else if *namespace != "" {
+		fmt.Fprintf(os.Stderr, "Ignoring namespace %q, %s is cluster-scoped\n", *namespace, gvr.Resource)
+	}
+	return &tablelistconvert.Client{ResourceInterface: resInt}, nil
+}
+
+// listAll lists every page when opts.Limit is set, and returns them as a single
+// list. The column definitions and resourceVersion are the ones of the first
+// page: the following pages are served from the same snapshot, so watching from
+// that resourceVersion doesn't miss anything.
+func listAll(ctx context.Context, table *tablelistconvert.Client, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	list, err := table.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for opts.Limit > 0 && list.GetContinue() != "" {
+		opts.Continue = list.GetContinue()
+		page, err := table.List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Listed page with %d rows\n", len(page.Items))
+		list.Items = append(list.Items, page.Items...)
+		list.SetContinue(page.GetContinue())
+	}
+	return list, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const defaultPageSize = 50
+
+// tableCache keeps the latest rows of a Table list/watch in memory, keyed by
+// UID, and serves them sorted, filtered and paginated. It's a small version of
+// what steve does to serve tables to the UI, to evaluate whether Table listing
+// is enough for a UI backend.
+//
+// The query parameters follow steve:
+//
+//	?sort=Name        sort by the Name column, -Name for descending
+//	?filter=Status=Ac keep rows whose Status cell contains "Ac", can be repeated
+//	?page=2&pagesize=10
+type tableCache struct {
+	lock    sync.RWMutex
+	columns []metav1.TableColumnDefinition
+	rows    map[types.UID]tableRow
+}
+
+type tableRow struct {
+	UID       types.UID     `json:"uid"`
+	Namespace string        `json:"namespace,omitempty"`
+	Name      string        `json:"name"`
+	Cells     []interface{} `json:"cells"`
+}
+
+// tableQuery is what a client asks for
+type tableQuery struct {
+	// SortBy is a column name. Rows are sorted by namespace/name if empty.
+	SortBy     string
+	Descending bool
+	// Filters are column name => substring that the cell must contain
+	Filters  map[string]string
+	Page     int
+	PageSize int
+}
+
+// tablePage is what a client receives
+type tablePage struct {
+	Columns  []metav1.TableColumnDefinition `json:"columns"`
+	Rows     []tableRow                     `json:"rows"`
+	Total    int                            `json:"total"`
+	Page     int                            `json:"page"`
+	PageSize int                            `json:"pageSize"`
+	Pages    int                            `json:"pages"`
+}
+
+func newTableCache() *tableCache {
+	return &tableCache{
+		rows: map[types.UID]tableRow{},
+	}
+}
+
+// SetList replaces all rows with the ones of the list
+func (c *tableCache) SetList(list *unstructured.UnstructuredList) error {
+	columns, err := columnDefinitions(list)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.columns = columns
+	c.rows = map[types.UID]tableRow{}
+	for i := range list.Items {
+		c.setRow(&list.Items[i])
+	}
+	return nil
+}
+
+// HandleEvent updates the rows with a watch event. It returns false if the
+// event wasn't about a row.
+func (c *tableCache) HandleEvent(event watch.Event) bool {
+	obj, ok := event.Object.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch event.Type {
+	case watch.Added, watch.Modified:
+		c.setRow(obj)
+	case watch.Deleted:
+		delete(c.rows, obj.GetUID())
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *tableCache) setRow(obj *unstructured.Unstructured) {
+	c.rows[obj.GetUID()] = tableRow{
+		UID:       obj.GetUID(),
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		Cells:     rowCells(obj),
+	}
+}
+
+func (c *tableCache) columnIndex(name string) (int, error) {
+	for i, column := range c.columns {
+		if strings.EqualFold(column.Name, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown column %q", name)
+}
+
+// Query returns one page of rows
+func (c *tableCache) Query(q tableQuery) (tablePage, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	filters := map[int]string{}
+	for name, value := range q.Filters {
+		i, err := c.columnIndex(name)
+		if err != nil {
+			return tablePage{}, err
+		}
+		filters[i] = value
+	}
+
+	rows := make([]tableRow, 0, len(c.rows))
+	for _, row := range c.rows {
+		if matchesFilters(row, filters) {
+			rows = append(rows, row)
+		}
+	}
+
+	sortIndex := -1
+	if q.SortBy != "" {
+		i, err := c.columnIndex(q.SortBy)
+		if err != nil {
+			return tablePage{}, err
+		}
+		sortIndex = i
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if q.Descending {
+			return lessRow(rows[j], rows[i], sortIndex)
+		}
+		return lessRow(rows[i], rows[j], sortIndex)
+	})
+
+	pageSize := q.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	page := q.Page
+	if page <= 0 {
+		page = 1
+	}
+	start := min((page-1)*pageSize, len(rows))
+	end := min(start+pageSize, len(rows))
+
+	return tablePage{
+		Columns:  c.columns,
+		Rows:     rows[start:end],
+		Total:    len(rows),
+		Page:     page,
+		PageSize: pageSize,
+		Pages:    (len(rows) + pageSize - 1) / pageSize,
+	}, nil
+}
+
+func matchesFilters(row tableRow, filters map[int]string) bool {
+	for i, value := range filters {
+		if !strings.Contains(strings.ToLower(formatCell(row.Cells, i)), strings.ToLower(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// lessRow compares two rows by the cell at index, numerically if both cells
+// are numbers. Ties, and index -1, fall back to namespace/name.
+func lessRow(a, b tableRow, index int) bool {
+	if index >= 0 {
+		aCell, bCell := cellAt(a.Cells, index), cellAt(b.Cells, index)
+		aNum, aIsNum := aCell.(float64)
+		bNum, bIsNum := bCell.(float64)
+		if aIsNum && bIsNum {
+			if aNum != bNum {
+				return aNum < bNum
+			}
+		} else if aStr, bStr := formatCell(a.Cells, index), formatCell(b.Cells, index); aStr != bStr {
+			return aStr < bStr
+		}
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+func cellAt(cells []interface{}, i int) interface{} {
+	if i >= len(cells) {
+		return nil
+	}
+	return cells[i]
+}
+
+func (c *tableCache) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	q, err := parseTableQuery(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := c.Query(q)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(page); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func parseTableQuery(req *http.Request) (tableQuery, error) {
+	values := req.URL.Query()
+	q := tableQuery{
+		Filters: map[string]string{},
+	}
+
+	q.SortBy = values.Get("sort")
+	if strings.HasPrefix(q.SortBy, "-") {
+		q.Descending = true
+		q.SortBy = q.SortBy[1:]
+	}
+
+	for _, filter := range values["filter"] {
+		column, value, ok := strings.Cut(filter, "=")
+		if !ok {
+			return q, fmt.Errorf("invalid filter %q, expected column=value", filter)
+		}
+		q.Filters[column] = value
+	}
+
+	var err error
+	if page := values.Get("page"); page != "" {
+		if q.Page, err = strconv.Atoi(page); err != nil {
+			return q, fmt.Errorf("invalid page: %w", err)
+		}
+	}
+	if pageSize := values.Get("pagesize"); pageSize != "" {
+		if q.PageSize, err = strconv.Atoi(pageSize); err != nil {
+			return q, fmt.Errorf("invalid pagesize: %w", err)
+		}
+	}
+	return q, nil
+}
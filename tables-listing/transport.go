@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// contentFormat is the representation we ask the apiserver for, through the
+// Accept header
+type contentFormat string
+
+const (
+	// formatDefault leaves the Accept header set by client-go untouched
+	formatDefault                   contentFormat = ""
+	formatTable                     contentFormat = "Table"
+	formatPartialObjectMetadata     contentFormat = "PartialObjectMetadata"
+	formatPartialObjectMetadataList contentFormat = "PartialObjectMetadataList"
+	formatProtobuf                  contentFormat = "Protobuf"
+)
+
+var acceptHeaders = map[contentFormat]string{
+	formatTable:                     "application/json;as=Table;v=v1;g=meta.k8s.io,application/json;as=Table;v=v1beta1;g=meta.k8s.io",
+	formatPartialObjectMetadata:     "application/json;as=PartialObjectMetadata;v=v1;g=meta.k8s.io,application/json;as=PartialObjectMetadata;v=v1beta1;g=meta.k8s.io",
+	formatPartialObjectMetadataList: "application/json;as=PartialObjectMetadataList;v=v1;g=meta.k8s.io,application/json;as=PartialObjectMetadataList;v=v1beta1;g=meta.k8s.io",
+	formatProtobuf:                  "application/vnd.kubernetes.protobuf,application/json",
+}
+
+// negotiation is what to ask for
+type negotiation struct {
+	Format contentFormat
+	// IncludeObject is only used with formatTable. Empty means the server
+	// default (Metadata).
+	IncludeObject metav1.IncludeObjectPolicy
+}
+
+// negotiationRule applies a negotiation to matching requests
+type negotiationRule struct {
+	// Resource matches the resource of the request, eg: "pods" or
+	// "deployments.apps". Empty matches every resource.
+	Resource string
+	// Verbs matches "get", "list" or "watch". Empty matches every verb.
+	Verbs []string
+
+	negotiation
+}
+
+func (r negotiationRule) matches(info requestInfo) bool {
+	if r.Resource != "" && r.Resource != info.Resource && r.Resource != info.Resource+"."+info.Group {
+		return false
+	}
+	if len(r.Verbs) == 0 {
+		return true
+	}
+	for _, verb := range r.Verbs {
+		if verb == info.Verb {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiatingTransport sets the Accept header (and includeObject for Tables)
+// per request. This replaces the previous addQuery transport, which asked for
+// Tables on every single request.
+//
+// Rules are checked in order and the first match wins. Requests matching no
+// rule use Default. Query values already set by the caller are never
+// overwritten.
+type negotiatingTransport struct {
+	next    http.RoundTripper
+	Default negotiation
+	Rules   []negotiationRule
+}
+
+func newNegotiatingTransport(next http.RoundTripper, def negotiation, rules ...negotiationRule) *negotiatingTransport {
+	return &negotiatingTransport{
+		next:    next,
+		Default: def,
+		Rules:   rules,
+	}
+}
+
+func (t *negotiatingTransport) negotiationFor(req *http.Request) negotiation {
+	info, ok := parseRequestInfo(req)
+	if !ok {
+		return negotiation{}
+	}
+	for _, rule := range t.Rules {
+		if rule.matches(info) {
+			return rule.negotiation
+		}
+	}
+	return t.Default
+}
+
+func (t *negotiatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := t.negotiationFor(req)
+	if n.Format == formatDefault {
+		return t.next.RoundTrip(req)
+	}
+
+	accept, ok := acceptHeaders[n.Format]
+	if !ok {
+		return nil, fmt.Errorf("unknown content format %q", n.Format)
+	}
+
+	// RoundTrippers must not modify the request they're given
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept", accept)
+	if n.Format == formatTable && n.IncludeObject != "" {
+		q := req.URL.Query()
+		if !q.Has("includeObject") {
+			q.Set("includeObject", string(n.IncludeObject))
+			req.URL.RawQuery = q.Encode()
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// requestInfo is the little we need to know about a request to the apiserver
+type requestInfo struct {
+	Group    string
+	Resource string
+	// Verb is one of get, list or watch. Other verbs are ignored.
+	Verb string
+}
+
+// parseRequestInfo parses paths like:
+//
+//	/api/v1/pods
+//	/api/v1/namespaces/default/pods/foo
+//	/apis/apps/v1/namespaces/default/deployments
+//
+// It's a much simpler version of the apiserver's RequestInfoFactory, which is
+// good enough for reads.
+func parseRequestInfo(req *http.Request) (requestInfo, bool) {
+	if req.Method != http.MethodGet {
+		return requestInfo{}, false
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	var info requestInfo
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		info.Group = parts[1]
+		parts = parts[3:]
+	default:
+		return requestInfo{}, false
+	}
+
+	// /namespaces/{namespace}/{resource}, but not /namespaces/{name}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		parts = parts[2:]
+	}
+
+	info.Resource = parts[0]
+	switch {
+	case len(parts) > 1:
+		info.Verb = "get"
+	case req.URL.Query().Get("watch") == "true" || req.URL.Query().Get("watch") == "1":
+		info.Verb = "watch"
+	default:
+		info.Verb = "list"
+	}
+	return info, true
+}
+
+// parseIncludeRules parses resource=IncludeObjectPolicy pairs, eg:
+// "pods=Metadata,deployments.apps=None"
+func parseIncludeRules(s string) ([]negotiationRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var rules []negotiationRule
+	for _, pair := range strings.Split(s, ",") {
+		resource, policy, ok := strings.Cut(pair, "=")
+		if !ok || resource == "" {
+			return nil, fmt.Errorf("invalid include rule %q, expected resource=policy", pair)
+		}
+		switch metav1.IncludeObjectPolicy(policy) {
+		case metav1.IncludeNone, metav1.IncludeMetadata, metav1.IncludeObject:
+		default:
+			return nil, fmt.Errorf("invalid include rule %q, policy must be None, Metadata or Object", pair)
+		}
+		rules = append(rules, negotiationRule{
+			Resource: resource,
+			negotiation: negotiation{
+				Format:        formatTable,
+				IncludeObject: metav1.IncludeObjectPolicy(policy),
+			},
+		})
+	}
+	return rules, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordedRequest is what the test server received
+type recordedRequest struct {
+	Accept string
+	Query  url.Values
+}
+
+// newRecordingServer returns a server recording the requests it receives, and
+// a client sending them through transport
+func newRecordingServer(t *testing.T, wrap func(http.RoundTripper) http.RoundTripper) (*httptest.Server, *http.Client, *[]recordedRequest) {
+	var requests []recordedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests = append(requests, recordedRequest{
+			Accept: req.Header.Get("Accept"),
+			Query:  req.URL.Query(),
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &http.Client{Transport: wrap(http.DefaultTransport)}, &requests
+}
+
+func TestNegotiatingTransport(t *testing.T) {
+	wrap := func(rt http.RoundTripper) http.RoundTripper {
+		return newNegotiatingTransport(rt,
+			negotiation{Format: formatTable, IncludeObject: metav1.IncludeMetadata},
+			negotiationRule{
+				Resource:    "pods",
+				Verbs:       []string{"watch"},
+				negotiation: negotiation{Format: formatTable, IncludeObject: metav1.IncludeNone},
+			},
+			negotiationRule{
+				Resource:    "deployments.apps",
+				Verbs:       []string{"get"},
+				negotiation: negotiation{Format: formatPartialObjectMetadata},
+			},
+			negotiationRule{
+				Resource:    "secrets",
+				negotiation: negotiation{Format: formatDefault},
+			},
+		)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		accept      string
+		wantAccept  string
+		wantInclude string
+	}{
+		{
+			name:        "list uses the default",
+			method:      http.MethodGet,
+			path:        "/api/v1/namespaces/default/pods",
+			wantAccept:  acceptHeaders[formatTable],
+			wantInclude: "Metadata",
+		},
+		{
+			name:        "watch matches the pods rule",
+			method:      http.MethodGet,
+			path:        "/api/v1/namespaces/default/pods?watch=true",
+			wantAccept:  acceptHeaders[formatTable],
+			wantInclude: "None",
+		},
+		{
+			name:        "get of pods doesn't match the watch rule",
+			method:      http.MethodGet,
+			path:        "/api/v1/namespaces/default/pods/foo",
+			wantAccept:  acceptHeaders[formatTable],
+			wantInclude: "Metadata",
+		},
+		{
+			name:       "get matches the deployments rule",
+			method:     http.MethodGet,
+			path:       "/apis/apps/v1/namespaces/default/deployments/foo",
+			wantAccept: acceptHeaders[formatPartialObjectMetadata],
+		},
+		{
+			name:        "list doesn't match the deployments rule",
+			method:      http.MethodGet,
+			path:        "/apis/apps/v1/deployments",
+			wantAccept:  acceptHeaders[formatTable],
+			wantInclude: "Metadata",
+		},
+		{
+			name:       "default format leaves the request alone",
+			method:     http.MethodGet,
+			path:       "/api/v1/namespaces/default/secrets",
+			accept:     "application/json",
+			wantAccept: "application/json",
+		},
+		{
+			name:        "includeObject set by the caller is kept",
+			method:      http.MethodGet,
+			path:        "/api/v1/namespaces/default/pods?includeObject=Object",
+			wantAccept:  acceptHeaders[formatTable],
+			wantInclude: "Object",
+		},
+		{
+			name:       "non-GET requests pass through",
+			method:     http.MethodPost,
+			path:       "/api/v1/namespaces/default/pods",
+			accept:     "application/json",
+			wantAccept: "application/json",
+		},
+		{
+			name:       "non-API paths pass through",
+			method:     http.MethodGet,
+			path:       "/version",
+			accept:     "application/json",
+			wantAccept: "application/json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, client, requests := newRecordingServer(t, wrap)
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if len(*requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(*requests))
+			}
+			got := (*requests)[0]
+			if got.Accept != tt.wantAccept {
+				t.Errorf("Accept = %q, want %q", got.Accept, tt.wantAccept)
+			}
+			if include := got.Query.Get("includeObject"); include != tt.wantInclude {
+				t.Errorf("includeObject = %q, want %q", include, tt.wantInclude)
+			}
+			if tt.method != http.MethodGet && got.Query.Encode() != req.URL.Query().Encode() {
+				t.Errorf("query = %q, want it unchanged", got.Query.Encode())
+			}
+		})
+	}
+}
+
+func TestNegotiatingTransportDoesntModifyRequest(t *testing.T) {
+	srv, client, _ := newRecordingServer(t, func(rt http.RoundTripper) http.RoundTripper {
+		return newNegotiatingTransport(rt, negotiation{Format: formatTable, IncludeObject: metav1.IncludeNone})
+	})
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/pods", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if req.Header.Get("Accept") != "" || req.URL.RawQuery != "" {
+		t.Errorf("request was modified: Accept=%q query=%q", req.Header.Get("Accept"), req.URL.RawQuery)
+	}
+}
+
+func TestParseRequestInfo(t *testing.T) {
+	tests := []struct {
+		path string
+		want requestInfo
+		ok   bool
+	}{
+		{path: "/api/v1/pods", want: requestInfo{Resource: "pods", Verb: "list"}, ok: true},
+		{path: "/api/v1/namespaces", want: requestInfo{Resource: "namespaces", Verb: "list"}, ok: true},
+		{path: "/api/v1/namespaces/default", want: requestInfo{Resource: "namespaces", Verb: "get"}, ok: true},
+		{path: "/api/v1/namespaces/default/pods?watch=1", want: requestInfo{Resource: "pods", Verb: "watch"}, ok: true},
+		{path: "/apis/apps/v1/namespaces/default/deployments/foo", want: requestInfo{Group: "apps", Resource: "deployments", Verb: "get"}, ok: true},
+		{path: "/healthz", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			got, ok := parseRequestInfo(req)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("parseRequestInfo() = %+v, %t, want %+v, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseIncludeRules(t *testing.T) {
+	rules, err := parseIncludeRules("pods=Metadata,deployments.apps=None")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("got %d rules, want 2", len(rules))
+	}
+	if rules[0].Resource != "pods" || rules[0].IncludeObject != metav1.IncludeMetadata || rules[0].Format != formatTable {
+		t.Errorf("rules[0] = %+v", rules[0])
+	}
+	if rules[1].Resource != "deployments.apps" || rules[1].IncludeObject != metav1.IncludeNone {
+		t.Errorf("rules[1] = %+v", rules[1])
+	}
+
+	for _, malformed := range []string{"pods", "pods=Metadata,", "=None", "pods=Everything", "pods:None"} {
+		if _, err := parseIncludeRules(malformed); err == nil {
+			t.Errorf("parseIncludeRules(%q) didn't fail", malformed)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rancher/steve/pkg/stores/proxyalpha/tablelistconvert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// rewatchDelay is how long to wait before watching again after a failure, so
+// that an unreachable apiserver isn't hammered
+const rewatchDelay = time.Second
+
+// errResourceExpired means the resourceVersion we watch from is too old and
+// the only way forward is to relist
+var errResourceExpired = errors.New("resource version expired")
+
+// tableWatcher lists then watches a Table until ctx is cancelled.
+//
+// A watch doesn't last forever: the apiserver closes it after a timeout
+// (5-10 minutes by default), and the connection can drop. When that happens,
+// tableWatcher watches again from the last resourceVersion it saw, so no event
+// is missed. Bookmarks keep that resourceVersion fresh even when nothing
+// changes. If the resourceVersion is too old (410 Gone), it relists and calls
+// OnList again, like an informer would.
+type tableWatcher struct {
+	// Name prefixes the logs, to tell clusters apart. Can be empty.
+	Name  string
+	table *tablelistconvert.Client
+	// opts are the selectors and page size. Continue is only used by the
+	// first list.
+	opts metav1.ListOptions
+
+	// OnList is called with the first list and after every relist
+	OnList func(*unstructured.UnstructuredList) error
+	// OnEvent is called for every event except bookmarks
+	OnEvent func(watch.Event) error
+	// MaxFailures is how many watches or relists in a row can fail before
+	// Run gives up and returns the error. 0 means Run never gives up.
+	MaxFailures int
+
+	resourceVersion string
+	failures        int
+}
+
+// List does the first list, and must be called before Run
+func (w *tableWatcher) List(ctx context.Context) error {
+	list, err := listAll(ctx, w.table, w.opts)
+	if err != nil {
+		return err
+	}
+	w.resourceVersion = list.GetResourceVersion()
+	return w.OnList(list)
+}
+
+// Run watches until ctx is cancelled, in which case it returns nil. It
+// returns an error if OnList or OnEvent do, or after MaxFailures failures in a
+// row.
+func (w *tableWatcher) Run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		resourceVersion := w.resourceVersion
+		err := w.watch(ctx)
+		// A watch that got events or bookmarks before failing did work
+		if w.resourceVersion != resourceVersion {
+			w.failures = 0
+		}
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, errResourceExpired):
+			w.logf("Resource version %s expired, relisting\n", w.resourceVersion)
+			if err := w.relist(ctx); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			var handlerErr handlerError
+			if errors.As(err, &handlerErr) {
+				return handlerErr.err
+			}
+			if w.failed() {
+				return err
+			}
+			w.logf("Watch failed, watching again from %s: %v\n", w.resourceVersion, err)
+		default:
+			// The apiserver closing a watch is routine, no need to wait
+			w.logf("Watch closed, watching again from %s\n", w.resourceVersion)
+			continue
+		}
+		sleep(ctx, rewatchDelay)
+	}
+	return nil
+}
+
+// relist lists until it succeeds, ctx is cancelled or MaxFailures is reached
+func (w *tableWatcher) relist(ctx context.Context) error {
+	opts := w.opts
+	opts.Continue = ""
+	for ctx.Err() == nil {
+		list, err := listAll(ctx, w.table, opts)
+		if err != nil {
+			if w.failed() {
+				return err
+			}
+			w.logf("Relist failed: %v\n", err)
+			sleep(ctx, rewatchDelay)
+			continue
+		}
+		w.resourceVersion = list.GetResourceVersion()
+		w.failures = 0
+		return w.OnList(list)
+	}
+	return nil
+}
+
+// failed counts a failure and returns whether Run should give up
+func (w *tableWatcher) failed() bool {
+	w.failures++
+	return w.MaxFailures > 0 && w.failures >= w.MaxFailures
+}
+
+// handlerError wraps errors returned by OnEvent, which stop Run instead of
+// triggering a new watch
+type handlerError struct {
+	err error
+}
+
+func (e handlerError) Error() string {
+	return e.err.Error()
+}
+
+// watch does a single watch, until it's closed or fails.
+//
+// It watches through the dynamic client wrapped by tablelistconvert, not
+// through tablelistconvert's Watch:
+//   - it drops events that aren't Unstructured, including the errors of a
+//     410, which would then look like a closed watch and never relist
+//   - its Stop prints to stdout, in the middle of the -o json output
+//   - its goroutine blocks forever if the watch is stopped while it sends
+//
+// Rows are converted to objects the same way, see rowToObject.
+func (w *tableWatcher) watch(ctx context.Context) error {
+	watcher, err := w.table.ResourceInterface.Watch(ctx, metav1.ListOptions{
+		LabelSelector:       w.opts.LabelSelector,
+		FieldSelector:       w.opts.FieldSelector,
+		ResourceVersion:     w.resourceVersion,
+		AllowWatchBookmarks: true,
+	})
+	if isExpired(err) {
+		return errResourceExpired
+	}
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return nil
+			}
+			if event.Type == watch.Error {
+				err := apierrors.FromObject(event.Object)
+				if isExpired(err) {
+					return errResourceExpired
+				}
+				return err
+			}
+
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			rowToObject(obj)
+			// Rows with include None have no object, so there's no
+			// resourceVersion to keep track of. A relist on 410 is then
+			// our only way to catch up.
+			if obj.GetResourceVersion() != "" {
+				w.resourceVersion = obj.GetResourceVersion()
+			}
+			if event.Type == watch.Bookmark {
+				continue
+			}
+			if err := w.OnEvent(event); err != nil {
+				return handlerError{err: err}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// rowToObject turns the single row Table of a watch event into the row's
+// object, with the cells in .metadata.fields, like tablelistconvert does.
+// Anything else, eg: a Table whose row has no object, is left alone.
+func rowToObject(obj *unstructured.Unstructured) {
+	if obj.GetKind() != "Table" || (obj.GetAPIVersion() != "meta.k8s.io/v1" && obj.GetAPIVersion() != "meta.k8s.io/v1beta1") {
+		return
+	}
+	rows, _, _ := unstructured.NestedSlice(obj.Object, "rows")
+	if len(rows) != 1 {
+		return
+	}
+	row, _ := rows[0].(map[string]interface{})
+	object, ok := row["object"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	cells, _ := row["cells"].([]interface{})
+	if err := unstructured.SetNestedSlice(object, cells, "metadata", "fields"); err != nil {
+		return
+	}
+	obj.Object = object
+}
+
+// isExpired returns whether err is a 410, ie: the resourceVersion is too old
+func isExpired(err error) bool {
+	return apierrors.IsResourceExpired(err) || apierrors.IsGone(err)
+}
+
+func (w *tableWatcher) logf(format string, args ...interface{}) {
+	if w.Name != "" {
+		format = "[" + w.Name + "] " + format
+	}
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
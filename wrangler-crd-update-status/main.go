@@ -3,6 +3,7 @@ package main
 //go:generate go run pkg/codegen/main.go
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -88,5 +89,6 @@ func mainErr() error {
 	_, err = exampleCtrl.Example().V1().Bar().UpdateStatus(respBar)
 	fmt.Println("Updating status of Bar, error is:", err)
 
-	return nil
+	// Look at statusPatchExample's comment for more info
+	return statusPatchExample(context.Background(), controllerFactory, exampleCtrl)
 }
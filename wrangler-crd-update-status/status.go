@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rancher/lasso/pkg/client"
+	"github.com/rancher/lasso/pkg/controller"
+	examplev1 "github.com/tomleb/lasso-controller-notes/pkg/apis/example.com/v1"
+	wexample "github.com/tomleb/lasso-controller-notes/pkg/generated/controllers/example.com"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const statusFieldManager = "status-tutorial"
+
+// lassoClientFor returns the lasso client of a kind of example.com/v1.
+// wrangler's Patch doesn't take PatchOptions, lasso's does, and apply patches
+// need one since fieldManager is required.
+func lassoClientFor(controllerFactory controller.SharedControllerFactory, kind string) (*client.Client, error) {
+	return controllerFactory.SharedCacheFactory().SharedClientFactory().ForKind(examplev1.SchemeGroupVersion.WithKind(kind))
+}
+
+// PatchStatus patches the status subresource of an object, c comes from
+// lassoClientFor.
+//
+// For types.ApplyPatchType, patch must be a full apply configuration: apiVersion,
+// kind, metadata.name and metadata.namespace must be set. Conflicts with other field
+// managers are forced, which is what controllers owning the status usually want.
+func PatchStatus(ctx context.Context, c *client.Client, namespace, name string, pt types.PatchType, patch []byte, result runtime.Object) error {
+	opts := metav1.PatchOptions{
+		FieldManager: statusFieldManager,
+	}
+	if pt == types.ApplyPatchType {
+		force := true
+		opts.Force = &force
+	}
+	return c.Patch(ctx, namespace, name, pt, patch, result, opts, "status")
+}
+
+// statusMergePatch returns a merge patch that only touches .status
+func statusMergePatch(status any) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"status": status,
+	})
+}
+
+// statusApplyPatch returns an apply configuration that only sets .status
+func statusApplyPatch(kind, namespace, name string, status any) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"apiVersion": examplev1.SchemeGroupVersion.String(),
+		"kind":       kind,
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"status": status,
+	})
+}
+
+// statusPatchExample shows the following:
+//
+//  1. The status subresource of Foo can be patched, both with a merge patch and
+//     with an apply patch.
+//
+//  2. UpdateStatus always sends the resourceVersion, so it conflicts when the
+//     object is stale. A status patch without resourceVersion never conflicts,
+//     exactly like patches on the main resource.
+//
+//  3. Patching .status through the main resource of Foo is silently ignored: the
+//     status subresource is the only way to modify it.
+//
+//  4. Bar has no status subresource, so the same patch sent to "status" fails
+//     with NotFound, while sending it to the main resource works.
+func statusPatchExample(ctx context.Context, controllerFactory controller.SharedControllerFactory, exampleCtrl *wexample.Factory) error {
+	fooClient, err := lassoClientFor(controllerFactory, "Foo")
+	if err != nil {
+		return err
+	}
+	barClient, err := lassoClientFor(controllerFactory, "Bar")
+	if err != nil {
+		return err
+	}
+
+	fooCtrl := exampleCtrl.Example().V1().Foo()
+	foo := examplev1.Foo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo-patch",
+			Namespace: "default",
+		},
+		Status: examplev1.FooStatus{
+			Foo: "initial",
+		},
+	}
+	fooCtrl.Delete(foo.Namespace, foo.Name, &metav1.DeleteOptions{})
+	staleFoo, err := fooCtrl.Create(&foo)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	patch, err := statusMergePatch(examplev1.FooStatus{Foo: "merged"})
+	if err != nil {
+		return err
+	}
+	patchedFoo := &examplev1.Foo{}
+	err = PatchStatus(ctx, fooClient, foo.Namespace, foo.Name, types.MergePatchType, patch, patchedFoo)
+	fmt.Printf("Merge patching status of Foo, status is %q, error is: %v\n", patchedFoo.Status.Foo, err)
+
+	patch, err = statusApplyPatch("Foo", foo.Namespace, foo.Name, examplev1.FooStatus{Foo: "applied"})
+	if err != nil {
+		return err
+	}
+	patchedFoo = &examplev1.Foo{}
+	err = PatchStatus(ctx, fooClient, foo.Namespace, foo.Name, types.ApplyPatchType, patch, patchedFoo)
+	fmt.Printf("Apply patching status of Foo, status is %q, error is: %v\n", patchedFoo.Status.Foo, err)
+
+	// staleFoo still has the resourceVersion from the Create, so UpdateStatus
+	// conflicts just like Update would.
+	staleFoo.Status.Foo = "updated"
+	_, err = fooCtrl.UpdateStatus(staleFoo)
+	fmt.Println("Updating status of Foo with stale rv, is conflict:", apierrors.IsConflict(err))
+
+	// The same change as a patch with no resourceVersion goes through
+	patch, err = statusMergePatch(staleFoo.Status)
+	if err != nil {
+		return err
+	}
+	patchedFoo = &examplev1.Foo{}
+	err = PatchStatus(ctx, fooClient, foo.Namespace, foo.Name, types.MergePatchType, patch, patchedFoo)
+	fmt.Printf("Merge patching status of Foo from stale rv, status is %q, error is: %v\n", patchedFoo.Status.Foo, err)
+
+	// Opting in to conflict checking works the same as on the main resource
+	patch, err = json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"resourceVersion": staleFoo.ResourceVersion,
+		},
+		"status": examplev1.FooStatus{Foo: "with-rv"},
+	})
+	if err != nil {
+		return err
+	}
+	err = PatchStatus(ctx, fooClient, foo.Namespace, foo.Name, types.MergePatchType, patch, &examplev1.Foo{})
+	fmt.Println("Merge patching status of Foo with stale rv in the patch, is conflict:", apierrors.IsConflict(err))
+
+	// Sending the status patch to the main resource succeeds, but the status is
+	// left untouched
+	patch, err = statusMergePatch(examplev1.FooStatus{Foo: "main-resource"})
+	if err != nil {
+		return err
+	}
+	patchedFoo, err = fooCtrl.Patch(foo.Namespace, foo.Name, types.MergePatchType, patch)
+	fmt.Printf("Merge patching status of Foo through the main resource, status is %q, error is: %v\n", patchedFoo.Status.Foo, err)
+
+	barCtrl := exampleCtrl.Example().V1().Bar()
+	bar := examplev1.Bar{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bar-patch",
+			Namespace: "default",
+		},
+		Status: examplev1.BarStatus{
+			Bar: "initial",
+		},
+	}
+	barCtrl.Delete(bar.Namespace, bar.Name, &metav1.DeleteOptions{})
+	if _, err := barCtrl.Create(&bar); err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	patch, err = statusMergePatch(examplev1.BarStatus{Bar: "merged"})
+	if err != nil {
+		return err
+	}
+	err = PatchStatus(ctx, barClient, bar.Namespace, bar.Name, types.MergePatchType, patch, &examplev1.Bar{})
+	fmt.Println("Merge patching status of Bar, is not found:", apierrors.IsNotFound(err), "error is:", err)
+
+	patchedBar, err := barCtrl.Patch(bar.Namespace, bar.Name, types.MergePatchType, patch)
+	fmt.Printf("Merge patching status of Bar through the main resource, status is %q, error is: %v\n", patchedBar.Status.Bar, err)
+
+	return nil
+}